@@ -7,36 +7,73 @@ import (
 
 	"google.golang.org/grpc"
 
+	_ "github.com/duanckham/gel/compressor"
 	"github.com/duanckham/gel/gel"
-	"github.com/duanckham/gel/pb"
 )
 
-var client pb.GelServiceClient
-
 // New return an agent client.
-func New(serverHost string, serverPort int32, period time.Duration) gel.Gel {
-	c, err := grpc.Dial(fmt.Sprintf("%s:%d", serverHost, serverPort), grpc.WithInsecure())
-	if err != nil {
-		// TODO
-		fmt.Println("* grpc.Dial err:", err)
+func New(serverHost string, serverPort int32, period time.Duration, opts ...Option) gel.Gel {
+	o := &options{}
+
+	for _, opt := range opts {
+		opt(o)
 	}
 
 	// Connect to server.
-	client = pb.NewGelServiceClient(c)
+	t := newTransport(dial(serverHost, serverPort, o), o)
 
 	// Start to collect data.
-	return runGelAgent(context.Background(), period)
+	return runGelAgent(context.Background(), period, t, o)
 }
 
-func runGelAgent(ctx context.Context, period time.Duration) gel.Gel {
-	g := gel.New(period)
+func dial(serverHost string, serverPort int32, o *options) *grpc.ClientConn {
+	dialOpts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithStatsHandler(payloadHandler{}),
+	}
+
+	if o.token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(TokenCredentials(o.token)))
+	}
 
-	g.SetTrigger(func(r *pb.Record) {
-		_, err := client.SyncRecord(ctx, r)
-		if err != nil {
-			fmt.Println("* grpc.SyncRecord err:", err)
-		}
-	})
+	c, err := grpc.Dial(fmt.Sprintf("%s:%d", serverHost, serverPort), dialOpts...)
+	if err != nil {
+		// TODO
+		fmt.Println("* grpc.Dial err:", err)
+	}
+
+	return c
+}
+
+func runGelAgent(ctx context.Context, period time.Duration, t *transport, o *options) gel.Gel {
+	g := gel.New(period, o.gel...)
+	t.g = g
+	t.ctx = ctx
+
+	// The transport takes the place of a trigger, its errors have the
+	// records retried or spilled as the queue policy says.
+	exporterOpts := []gel.ExporterOption{}
+	if o.batch != nil {
+		exporterOpts = append(exporterOpts, gel.WithBatching(o.batch.maxBytes, o.batch.maxDelay))
+	}
+
+	g.AddExporter(gel.TriggerExporter, t, exporterOpts...)
 
 	return g
 }
+
+// TokenCredentials sends a bearer token with every call, over plain
+// connections too.
+type TokenCredentials string
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (t TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Bearer " + string(t),
+	}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (t TokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
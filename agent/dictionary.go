@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// dictionary numbers the log templates of every gel session, so a template
+// text goes over the wire until the server has acknowledged it and only its
+// id afterwards. Records spilled by a previous process keep their session and
+// get ids of their own. Sessions not sent for longer than sessionTTL are
+// forgotten, a relay forwards the records of many.
+type dictionary struct {
+	mu        sync.Mutex
+	sessions  map[string]*templates
+	lastPrune time.Time
+}
+
+// sessionTTL is how long the templates of a silent session are kept.
+const sessionTTL = 24 * time.Hour
+
+type templates struct {
+	ids      map[string]uint32
+	known    map[uint32]bool
+	lastSeen time.Time
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{
+		sessions:  map[string]*templates{},
+		lastPrune: time.Now(),
+	}
+}
+
+func (d *dictionary) session(session string) *templates {
+	t, ok := d.sessions[session]
+	if !ok {
+		t = &templates{
+			ids:   map[string]uint32{},
+			known: map[uint32]bool{},
+		}
+
+		d.sessions[session] = t
+	}
+
+	t.lastSeen = time.Now()
+
+	return t
+}
+
+func (d *dictionary) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < time.Minute {
+		return
+	}
+
+	d.lastPrune = now
+
+	for session, t := range d.sessions {
+		if now.Sub(t.lastSeen) > sessionTTL {
+			delete(d.sessions, session)
+		}
+	}
+}
+
+// encode moves the logs of r to its template ids, defining the templates
+// the server does not know yet. It returns the ids defined.
+func (d *dictionary) encode(r *pb.Record) []uint32 {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+
+	if len(r.Logs) == 0 {
+		return nil
+	}
+
+	d.prune(time.Now())
+
+	t := d.session(r.Session)
+	defined := []uint32{}
+
+	if r.TemplateLogs == nil {
+		r.TemplateLogs = map[uint32]*pb.Logs{}
+	}
+
+	for template, logs := range r.Logs {
+		id, ok := t.ids[template]
+		if !ok {
+			id = uint32(len(t.ids) + 1)
+			t.ids[template] = id
+		}
+
+		if !t.known[id] {
+			if r.Templates == nil {
+				r.Templates = map[uint32]string{}
+			}
+
+			r.Templates[id] = template
+			defined = append(defined, id)
+		}
+
+		r.TemplateLogs[id] = logs
+	}
+
+	r.Logs = nil
+
+	return defined
+}
+
+// redefine adds the definition of every id used by r, after the server
+// lost track of some of them.
+func (d *dictionary) redefine(r *pb.Record) []uint32 {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+
+	t := d.session(r.Session)
+	t.known = map[uint32]bool{}
+
+	texts := map[uint32]string{}
+	for template, id := range t.ids {
+		texts[id] = template
+	}
+
+	defined := []uint32{}
+
+	for id := range r.TemplateLogs {
+		if r.Templates == nil {
+			r.Templates = map[uint32]string{}
+		}
+
+		r.Templates[id] = texts[id]
+		defined = append(defined, id)
+	}
+
+	return defined
+}
+
+// ack marks the ids of session as known by the server.
+func (d *dictionary) ack(session string, ids []uint32) {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+
+	t, ok := d.sessions[session]
+	if !ok {
+		return
+	}
+
+	for _, id := range ids {
+		t.known[id] = true
+	}
+}
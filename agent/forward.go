@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// Forwarder sends the records of other gel instances to a server, as a
+// relay does. Records keep their session and sequence number, so the
+// server tells their agents apart and drops the records it already has.
+type Forwarder struct {
+	t *transport
+}
+
+// NewForwarder returns a Forwarder to the server at serverHost:serverPort,
+// WithCompression and WithToken apply.
+func NewForwarder(serverHost string, serverPort int32, opts ...Option) *Forwarder {
+	o := &options{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return &Forwarder{
+		t: newTransport(dial(serverHost, serverPort, o), o),
+	}
+}
+
+// Forward delivers records in a single call, their logs are moved to
+// template ids on the way.
+func (f *Forwarder) Forward(ctx context.Context, records []*pb.Record) error {
+	return f.t.send(ctx, records)
+}
@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/duanckham/gel/gel"
+	"github.com/duanckham/gel/pb"
+)
+
+// Names of the series the local listener reports, tagged with the producer.
+const (
+	LocalRecordsName    = "gel.local.records"
+	LocalSuppressedName = "gel.local.suppressed"
+	LocalRejectedName   = "gel.local.rejected"
+)
+
+// ProducerTag is the tag naming the producer of the series received over the
+// local socket.
+const ProducerTag = "producer"
+
+// unsafeProducer are the characters a producer name cannot hold, as they
+// separate the tags of a series name.
+const unsafeProducer = ",={}"
+
+// maxFrame bounds the size of a frame of the local protocol.
+const maxFrame = 16 << 20
+
+// The local protocol is a stream of frames, each a 4 bytes big endian size
+// followed by as many bytes. The first frame is the name of the producer,
+// possibly empty, every next one a marshaled pb.Record.
+
+func writeFrame(w io.Writer, b []byte) error {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(b)))
+
+	if _, err := w.Write(size); err != nil {
+		return err
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size)
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// PeerCred is the identity of the process at the other end of a Unix
+// socket, as seen by the kernel.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type localOptions struct {
+	check func(PeerCred) error
+}
+
+// LocalOption configures a local listener.
+type LocalOption func(*localOptions)
+
+// WithPeerCheck rejects the producers for which check fails. Peer
+// credentials are only available on Linux, every producer is rejected
+// elsewhere.
+func WithPeerCheck(check func(PeerCred) error) LocalOption {
+	return func(o *localOptions) {
+		o.check = check
+	}
+}
+
+// WithAllowedUIDs only accepts the producers run by one of uids.
+func WithAllowedUIDs(uids ...uint32) LocalOption {
+	return WithPeerCheck(func(c PeerCred) error {
+		for _, uid := range uids {
+			if c.UID == uid {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("uid %d not allowed", c.UID)
+	})
+}
+
+// LocalListener merges the records of the local producers into a Gel.
+type LocalListener struct {
+	g    gel.Gel
+	l    *net.UnixListener
+	opts *localOptions
+}
+
+// ListenLocal accepts the records of local producers on the Unix socket
+// path and merges them into g, so they go upstream in its records. Every
+// number and instant is tagged with the producer name, or its pid when it
+// has none, and every log message carries it as its last parameter, past
+// the placeholders of the template. Producers whose name holds one of the
+// ",={}" separators of the tags are rejected.
+func ListenLocal(g gel.Gel, path string, opts ...LocalOption) (*LocalListener, error) {
+	o := &localOptions{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// A socket left behind by a previous process.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	ll := &LocalListener{
+		g:    g,
+		l:    l,
+		opts: o,
+	}
+
+	go ll.serve()
+
+	return ll, nil
+}
+
+// Close stops accepting producers and removes the socket.
+func (ll *LocalListener) Close() error {
+	return ll.l.Close()
+}
+
+func (ll *LocalListener) serve() {
+	for {
+		conn, err := ll.l.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		go ll.handle(conn)
+	}
+}
+
+func (ll *LocalListener) handle(conn *net.UnixConn) {
+	defer conn.Close()
+
+	cred, credErr := peerCred(conn)
+
+	if ll.opts.check != nil {
+		err := credErr
+		if err == nil {
+			err = ll.opts.check(cred)
+		}
+
+		if err != nil {
+			fmt.Println("* gel local producer rejected:", err)
+			ll.g.Increment(LocalRejectedName, 1)
+			return
+		}
+	}
+
+	r := bufio.NewReader(conn)
+
+	name, err := readFrame(r)
+	if err != nil {
+		return
+	}
+
+	producer := string(name)
+	if strings.ContainsAny(producer, unsafeProducer) {
+		fmt.Println("* gel local producer rejected: name", strconv.Quote(producer))
+		ll.g.Increment(LocalRejectedName, 1)
+		return
+	}
+
+	if producer == "" {
+		producer = "unknown"
+		if credErr == nil {
+			producer = strconv.Itoa(int(cred.PID))
+		}
+	}
+
+	for {
+		b, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("* gel local read err:", producer, err)
+			}
+
+			return
+		}
+
+		rec := &pb.Record{}
+		if err := proto.Unmarshal(b, rec); err != nil {
+			fmt.Println("* gel local record err:", producer, err)
+			return
+		}
+
+		ll.merge(producer, rec)
+	}
+}
+
+// merge adds the content of r to the current round of the Gel, the log
+// messages with their time in r and as sampled by the producer.
+func (ll *LocalListener) merge(producer string, r *pb.Record) {
+	g := ll.g
+
+	start, err := ptypes.Timestamp(r.Start)
+	if err != nil {
+		start = time.Now()
+	}
+
+	g.Increment(tagged(LocalRecordsName, producer), 1)
+
+	for k, v := range r.Numbers {
+		g.Increment(tagged(k, producer), v)
+	}
+
+	for k, v := range r.Instants {
+		g.Gauge(tagged(k, producer), v)
+	}
+
+	for template, logs := range r.Logs {
+		gel.MergeLogs(g, template, produced(template, logs, producer), start)
+
+		if logs.Suppressed > 0 {
+			g.Increment(tagged(LocalSuppressedName, producer), logs.Suppressed)
+		}
+	}
+}
+
+// tagged adds the producer tag to the name of a number or an instant, next to
+// the tags it already has.
+func tagged(name, producer string) string {
+	if strings.HasSuffix(name, "}") {
+		if i := strings.LastIndexByte(name, '{'); i > 0 {
+			return name[:len(name)-1] + "," + ProducerTag + "=" + producer + "}"
+		}
+	}
+
+	return gel.TaggedName(name, ProducerTag, producer)
+}
+
+// produced returns logs with producer appended to the parameters of every
+// message, after one parameter per placeholder of template, so the template
+// and the message formatted are left as they are.
+func produced(template string, logs *pb.Logs, producer string) *pb.Logs {
+	n := strings.Count(template, gel.LogVariablePlaceholder)
+
+	p := &pb.Logs{
+		Logs:       make([]*pb.Message, 0, len(logs.Logs)),
+		Suppressed: logs.Suppressed,
+	}
+
+	for _, m := range logs.Logs {
+		parameters := make([]string, n, n+1)
+		copy(parameters, m.Parameters)
+
+		for i := len(m.Parameters); i < n; i++ {
+			parameters[i] = gel.LogVariablePlaceholder
+		}
+
+		p.Logs = append(p.Logs, &pb.Message{
+			Parameters: append(parameters, producer),
+			Offset:     m.Offset,
+			Level:      m.Level,
+		})
+	}
+
+	return p
+}
+
+// NewLocal returns a Gel handing its records to the local agent listening
+// on the Unix socket path, as the producer set by WithProducer.
+func NewLocal(path string, period time.Duration, opts ...Option) gel.Gel {
+	o := &options{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	p := &localProducer{
+		path: path,
+		name: o.producer,
+	}
+
+	g := gel.New(period, o.gel...)
+
+	g.AddExporter(gel.TriggerExporter, gel.ExporterFunc(p.send))
+
+	return g
+}
+
+// localProducer writes records to the local socket, connecting again after
+// an error.
+type localProducer struct {
+	mu   sync.Mutex
+	path string
+	name string
+	conn net.Conn
+}
+
+func (p *localProducer) send(r *pb.Record) error {
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	defer p.mu.Unlock()
+	p.mu.Lock()
+
+	if p.conn == nil {
+		conn, err := net.Dial("unix", p.path)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFrame(conn, []byte(p.name)); err != nil {
+			conn.Close()
+			return err
+		}
+
+		p.conn = conn
+	}
+
+	if err := writeFrame(p.conn, b); err != nil {
+		p.conn.Close()
+		p.conn = nil
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/duanckham/gel/gel"
+)
+
+type options struct {
+	gel         []gel.Option
+	compression string
+	batch       *batchOptions
+	producer    string
+	token       string
+}
+
+type batchOptions struct {
+	maxBytes int
+	maxDelay time.Duration
+}
+
+// Option configures an agent.
+type Option func(*options)
+
+// WithGel passes options to the underlying gel.Gel.
+func WithGel(opts ...gel.Option) Option {
+	return func(o *options) {
+		o.gel = append(o.gel, opts...)
+	}
+}
+
+// WithCompression compresses the records sent with the named compressor,
+// compressor.Gzip or compressor.Zstd.
+func WithCompression(name string) Option {
+	return func(o *options) {
+		o.compression = name
+	}
+}
+
+// WithBatch coalesces records into a single SyncRecords call, sent once the
+// batch reaches maxBytes or its first record waited for maxDelay.
+func WithBatch(maxBytes int, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.batch = &batchOptions{
+			maxBytes: maxBytes,
+			maxDelay: maxDelay,
+		}
+	}
+}
+
+// WithProducer names the producer of a Gel made by NewLocal, which tags
+// its series on the local agent. The name cannot hold any of ",={}".
+func WithProducer(name string) Option {
+	return func(o *options) {
+		o.producer = name
+	}
+}
+
+// WithToken sends token to a server requiring one, see server.WithTokens.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
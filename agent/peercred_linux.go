@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads the credentials of the peer of conn with SO_PEERCRED.
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return PeerCred{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err != nil {
+		return PeerCred{}, err
+	}
+
+	if credErr != nil {
+		return PeerCred{}, credErr
+	}
+
+	return PeerCred{
+		PID: ucred.Pid,
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCred is not available outside Linux.
+func peerCred(conn *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, fmt.Errorf("peer credentials not supported")
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"github.com/duanckham/gel/gel"
+	"github.com/duanckham/gel/pb"
+)
+
+// Names of the series the agent reports about itself, per batch sent.
+const (
+	BatchRecordsName    = "gel.agent.batch.records"
+	BatchBytesName      = "gel.agent.batch.bytes"
+	BatchWireBytesName  = "gel.agent.batch.wire_bytes"
+	BatchSavedBytesName = "gel.agent.batch.saved_bytes"
+)
+
+// DuplicatesName counts the records the server had already received.
+const DuplicatesName = "gel.agent.duplicates"
+
+// transport sends records to the server, translating their templates
+// through the session dictionary.
+type transport struct {
+	ctx        context.Context
+	client     pb.GelServiceClient
+	dictionary *dictionary
+	callOpts   []grpc.CallOption
+	g          gel.Gel
+}
+
+func newTransport(c *grpc.ClientConn, o *options) *transport {
+	t := &transport{
+		client:     pb.NewGelServiceClient(c),
+		dictionary: newDictionary(),
+	}
+
+	if o.compression != "" {
+		t.callOpts = append(t.callOpts, grpc.UseCompressor(o.compression))
+	}
+
+	return t
+}
+
+// Export implements gel.Exporter, a record refused as invalid is not
+// retried.
+func (t *transport) Export(r *pb.Record) error {
+	return t.ExportBatch([]*pb.Record{r})
+}
+
+// ExportBatch implements gel.BatchExporter.
+func (t *transport) ExportBatch(records []*pb.Record) error {
+	err := t.send(t.ctx, records)
+	if status.Code(err) == codes.InvalidArgument {
+		return gel.Permanent(err)
+	}
+
+	return err
+}
+
+// send delivers records in a single call, resending every template
+// definition when the server lost track of some.
+func (t *transport) send(ctx context.Context, records []*pb.Record) error {
+	defined := make([][]uint32, len(records))
+	for i, r := range records {
+		defined[i] = t.dictionary.encode(r)
+	}
+
+	res, err := t.call(ctx, records)
+	if status.Code(err) == codes.FailedPrecondition {
+		for i, r := range records {
+			defined[i] = t.dictionary.redefine(r)
+		}
+
+		res, err = t.call(ctx, records)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	t.countDuplicates(res)
+
+	for i, r := range records {
+		t.dictionary.ack(r.Session, defined[i])
+	}
+
+	return nil
+}
+
+// countDuplicates reports the records of res the server did not count, as
+// they were delivered before. Like the batch sizes, it is called on the
+// sender and must not wait for its queue.
+func (t *transport) countDuplicates(res *pb.SyncResponse) {
+	if t.g == nil {
+		return
+	}
+
+	n := int64(0)
+	for _, s := range res.GetStatuses() {
+		if s == pb.SyncStatus_DUPLICATE {
+			n++
+		}
+	}
+
+	if n > 0 {
+		gel.IncrementNoWait(t.g, DuplicatesName, n)
+	}
+}
+
+// call sends records, a single one through SyncRecord for the servers that
+// predate batches. The sizes of the request are reported either way.
+func (t *transport) call(ctx context.Context, records []*pb.Record) (*pb.SyncResponse, error) {
+	p := &payload{}
+	ctx = context.WithValue(ctx, payloadKey{}, p)
+
+	var res *pb.SyncResponse
+	var err error
+
+	if len(records) == 1 {
+		res, err = t.client.SyncRecord(ctx, records[0], t.callOpts...)
+	} else {
+		res, err = t.client.SyncRecords(ctx, &pb.Records{
+			Records: records,
+		}, t.callOpts...)
+	}
+
+	// Called on the sender of the exporter, which must not wait for its own
+	// queue.
+	if err == nil && t.g != nil {
+		bytes := atomic.LoadInt64(&p.bytes)
+		wire := atomic.LoadInt64(&p.wire)
+
+		gel.IncrementNoWait(t.g, BatchRecordsName, int64(len(records)))
+		gel.IncrementNoWait(t.g, BatchBytesName, bytes)
+		gel.IncrementNoWait(t.g, BatchWireBytesName, wire)
+		gel.IncrementNoWait(t.g, BatchSavedBytesName, bytes-wire)
+	}
+
+	return res, err
+}
+
+// payload collects the sizes of the request of a call.
+type payload struct {
+	bytes int64
+	wire  int64
+}
+
+type payloadKey struct{}
+
+// payloadHandler fills the payload found in the context of a call, if any.
+type payloadHandler struct{}
+
+func (payloadHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (payloadHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	out, ok := s.(*stats.OutPayload)
+	if !ok {
+		return
+	}
+
+	if p, ok := ctx.Value(payloadKey{}).(*payload); ok {
+		atomic.AddInt64(&p.bytes, int64(out.Length))
+		atomic.AddInt64(&p.wire, int64(out.WireLength))
+	}
+}
+
+func (payloadHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (payloadHandler) HandleConn(context.Context, stats.ConnStats) {}
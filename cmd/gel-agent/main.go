@@ -0,0 +1,145 @@
+// Command gel-agent receives StatsD and DogStatsD metrics over UDP and TCP
+// and forwards them to a gel server, for the processes that cannot embed
+// the Go agent.
+//
+//	gel-agent -server 127.0.0.1:5024 -udp :8125 -tcp :8125
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/duanckham/gel/agent"
+	"github.com/duanckham/gel/gel"
+)
+
+// maxPacket is the largest UDP payload.
+const maxPacket = 65535
+
+func main() {
+	server := flag.String("server", "127.0.0.1:5024", "gel server address")
+	period := flag.Duration("period", 5*time.Second, "period of the records sent")
+	udp := flag.String("udp", ":8125", "UDP address to listen on, none when empty")
+	tcp := flag.String("tcp", "", "TCP address to listen on, none when empty")
+	compression := flag.String("compression", "", "compressor of the records sent, gzip or zstd")
+	buckets := flag.String("buckets", "1,2.5,5,10,25,50,100,250,500,1000,2500,5000,10000", "upper bounds of the histogram and distribution buckets")
+	token := flag.String("token", os.Getenv("GEL_TOKEN"), "token of the gel server")
+	flag.Parse()
+
+	if err := run(*server, *period, *udp, *tcp, *compression, *buckets, *token); err != nil {
+		fmt.Fprintln(os.Stderr, "gel-agent:", err)
+		os.Exit(1)
+	}
+}
+
+func run(server string, period time.Duration, udp, tcp, compression, buckets, token string) error {
+	host, portText, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return err
+	}
+
+	bounds := []float64{}
+	for _, b := range strings.Split(buckets, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return fmt.Errorf("bucket %q: %v", b, err)
+		}
+
+		bounds = append(bounds, v)
+	}
+
+	if udp == "" && tcp == "" {
+		return fmt.Errorf("no address to listen on")
+	}
+
+	opts := []agent.Option{
+		agent.WithGel(gel.WithAlignment()),
+	}
+
+	if compression != "" {
+		opts = append(opts, agent.WithCompression(compression))
+	}
+
+	if token != "" {
+		opts = append(opts, agent.WithToken(token))
+	}
+
+	s := newSink(bounds)
+	opts = append(opts, agent.WithGel(gel.WithRotation(s.reset)))
+	s.g = agent.New(host, int32(port), period, opts...)
+
+	errs := make(chan error, 2)
+
+	if udp != "" {
+		conn, err := net.ListenPacket("udp", udp)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("* statsd listening on udp", conn.LocalAddr())
+
+		go func() {
+			errs <- serveUDP(conn, s)
+		}()
+	}
+
+	if tcp != "" {
+		l, err := net.Listen("tcp", tcp)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("* statsd listening on tcp", l.Addr())
+
+		go func() {
+			errs <- serveTCP(l, s)
+		}()
+	}
+
+	return <-errs
+}
+
+func serveUDP(conn net.PacketConn, s *sink) error {
+	buf := make([]byte, maxPacket)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		s.handle(string(buf[:n]))
+	}
+}
+
+// serveTCP reads newline separated metrics from every connection.
+func serveTCP(l net.Listener, s *sink) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(nil, maxPacket)
+
+			for scanner.Scan() {
+				s.handle(scanner.Text())
+			}
+		}()
+	}
+}
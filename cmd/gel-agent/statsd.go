@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/duanckham/gel/gel"
+)
+
+// Names of the series the daemon reports about itself.
+const (
+	packetsName = "gel.statsd.packets"
+	metricsName = "gel.statsd.metrics"
+	errorsName  = "gel.statsd.errors"
+	droppedName = "gel.statsd.sets.dropped"
+)
+
+// maxGauges bounds the gauges whose last value is kept for the relative
+// updates, the ones updated the longest ago are forgotten first.
+const maxGauges = 10000
+
+// maxSetValues bounds the distinct values of the sets kept in a round, the
+// values past it are counted in droppedName rather than in their set.
+const maxSetValues = 10000
+
+// metric is a line of the StatsD protocol,
+// <name>:<value>[:<value>...]|<type>[|@<rate>][|#<tag>[:<value>],...].
+type metric struct {
+	name   string
+	values []string
+	typ    string
+	rate   float64
+	tags   []string
+}
+
+func parseLine(line string) (metric, error) {
+	m := metric{
+		rate: 1,
+	}
+
+	if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return m, fmt.Errorf("events and service checks are not supported")
+	}
+
+	fields := strings.Split(line, "|")
+	if len(fields) < 2 {
+		return m, fmt.Errorf("no type in %q", line)
+	}
+
+	i := strings.IndexByte(fields[0], ':')
+	if i <= 0 || i == len(fields[0])-1 {
+		return m, fmt.Errorf("no value in %q", line)
+	}
+
+	m.name = fields[0][:i]
+	m.values = strings.Split(fields[0][i+1:], ":")
+	m.typ = fields[1]
+
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, fmt.Errorf("bad sample rate in %q", line)
+			}
+
+			m.rate = rate
+
+		case strings.HasPrefix(f, "#"):
+			m.tags = parseTags(f[1:])
+		}
+
+		// Container ids, timestamps and other extensions are ignored.
+	}
+
+	return m, nil
+}
+
+// parseTags returns DogStatsD tags as key/value pairs sorted by key, so the
+// same tags in any order make the same series. A tag without a value gets
+// an empty one.
+func parseTags(s string) []string {
+	tags := strings.Split(s, ",")
+	sort.Strings(tags)
+
+	pairs := []string{}
+
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+
+		pairs = append(pairs, kv[0], kv[1])
+	}
+
+	return pairs
+}
+
+// sink maps StatsD metrics onto a Gel. Counters are incremented by their
+// value scaled by the sample rate, gauges set, relative ones (+n, -n)
+// added to their last value, timers observed in microseconds into
+// gel.DefaultLatencyBuckets, histograms and distributions observed as is
+// into buckets, and sets gauged with their count of distinct values per
+// round. The sets start over with every round, reset must be called when
+// the Gel rotates, see gel.WithRotation.
+type sink struct {
+	g       gel.Gel
+	buckets []float64
+
+	mu        sync.Mutex
+	gauges    map[string]*gauge
+	sets      map[string]map[string]bool
+	setValues int
+}
+
+type gauge struct {
+	value   float64
+	updated time.Time
+}
+
+func newSink(buckets []float64) *sink {
+	return &sink{
+		buckets: buckets,
+		gauges:  map[string]*gauge{},
+		sets:    map[string]map[string]bool{},
+	}
+}
+
+// handle applies the lines of a packet.
+func (s *sink) handle(packet string) {
+	s.g.Increment(packetsName, 1)
+
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		m, err := parseLine(line)
+		if err == nil {
+			err = s.apply(m)
+		}
+
+		if err != nil {
+			s.g.Increment(errorsName, 1)
+			continue
+		}
+
+		s.g.Increment(metricsName, 1)
+	}
+}
+
+func (s *sink) apply(m metric) error {
+	name := gel.TaggedName(m.name, m.tags...)
+
+	for _, value := range m.values {
+		if m.typ == "s" {
+			s.set(name, value)
+			continue
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+
+		switch m.typ {
+		case "c":
+			s.g.Increment(name, int64(math.Round(v/m.rate)))
+
+		case "g":
+			s.gauge(name, value, v)
+
+		case "ms":
+			gel.Observe(s.g, m.name, v*1000, gel.DefaultLatencyBuckets, m.tags...)
+
+		case "h", "d":
+			gel.Observe(s.g, m.name, v, s.buckets, m.tags...)
+
+		default:
+			return fmt.Errorf("unknown type %q", m.typ)
+		}
+	}
+
+	return nil
+}
+
+func (s *sink) gauge(name, value string, v float64) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	gg, ok := s.gauges[name]
+	if !ok {
+		if len(s.gauges) >= maxGauges {
+			s.evictGauge()
+		}
+
+		gg = &gauge{}
+		s.gauges[name] = gg
+	}
+
+	if value[0] == '+' || value[0] == '-' {
+		v += gg.value
+	}
+
+	gg.value = v
+	gg.updated = time.Now()
+
+	s.g.Gauge(name, v)
+}
+
+// evictGauge forgets the gauge updated the longest ago.
+func (s *sink) evictGauge() {
+	oldest := ""
+	var updated time.Time
+
+	for name, gg := range s.gauges {
+		if oldest == "" || gg.updated.Before(updated) {
+			oldest = name
+			updated = gg.updated
+		}
+	}
+
+	delete(s.gauges, oldest)
+}
+
+func (s *sink) set(name, value string) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	values := s.sets[name]
+	if values[value] {
+		return
+	}
+
+	if s.setValues >= maxSetValues {
+		s.g.Increment(droppedName, 1)
+		return
+	}
+
+	if values == nil {
+		values = map[string]bool{}
+		s.sets[name] = values
+	}
+
+	values[value] = true
+	s.setValues++
+
+	s.g.Gauge(name, float64(len(values)))
+}
+
+// reset forgets the values of the sets as a new round starts.
+func (s *sink) reset(start time.Time) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	s.sets = map[string]map[string]bool{}
+	s.setValues = 0
+}
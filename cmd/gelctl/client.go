@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+
+	"github.com/duanckham/gel/agent"
+	_ "github.com/duanckham/gel/compressor"
+	"github.com/duanckham/gel/pb"
+)
+
+const defaultAddr = "127.0.0.1:5024"
+
+// tokenEnv names the environment variable holding the token of the server.
+const tokenEnv = "GEL_TOKEN"
+
+func dial(addr string) (pb.GelServiceClient, error) {
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+	}
+
+	if token := os.Getenv(tokenEnv); token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(agent.TokenCredentials(token)))
+	}
+
+	c, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pb.NewGelServiceClient(c), nil
+}
+
+func parseLevel(s string) (pb.Level, error) {
+	v, ok := pb.Level_value[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown level %q", s)
+	}
+
+	return pb.Level(v), nil
+}
+
+// parseTime reads a time as RFC 3339 or as a duration before now.
+func parseTime(s string) (time.Time, error) {
+	if s == "" || s == "now" {
+		return time.Now(), nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func runTail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	addr := flags.String("addr", defaultAddr, "server address")
+	agent := flags.String("agent", "", "agent session")
+	template := flags.String("template", "", "substring of the log templates")
+	metric := flags.String("metric", "", "glob pattern of the numbers and instants")
+	level := flags.String("level", "info", "lowest level of the logs")
+	types := flags.String("types", "", "comma separated types among number, instant, log and suppressed")
+	flags.Parse(args)
+
+	lv, err := parseLevel(*level)
+	if err != nil {
+		return err
+	}
+
+	req := &pb.TailRequest{
+		Agent:    *agent,
+		Template: *template,
+		Metric:   *metric,
+		Level:    lv,
+	}
+
+	if *types != "" {
+		req.Types = strings.Split(*types, ",")
+	}
+
+	client, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+
+	stream, err := client.Tail(context.Background(), req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		u, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if u.Dropped > 0 {
+			fmt.Printf("... %d units dropped\n", u.Dropped)
+		}
+
+		t, _ := ptypes.Timestamp(u.Time)
+
+		switch u.Type {
+		case "log":
+			fmt.Println(formatTime(t), u.Agent, u.Level, u.Message)
+		case "suppressed":
+			fmt.Println(formatTime(t), u.Agent, "suppressed", u.Value, u.Key)
+		default:
+			fmt.Println(formatTime(t), u.Agent, u.Type, u.Key, u.Value)
+		}
+	}
+}
+
+func runQuery(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	addr := flags.String("addr", defaultAddr, "server address")
+	name := flags.String("name", "*", "glob pattern of the series names")
+	agent := flags.String("agent", "", "agent session, or * for the aggregates across agents")
+	from := flags.String("from", "1h", "start, RFC 3339 or a duration before now")
+	to := flags.String("to", "now", "end, RFC 3339 or a duration before now")
+	format := flags.String("format", "table", "output format, table, json or csv")
+	flags.Parse(args)
+
+	f, err := parseTime(*from)
+	if err != nil {
+		return err
+	}
+
+	t, err := parseTime(*to)
+	if err != nil {
+		return err
+	}
+
+	fromProto, _ := ptypes.TimestampProto(f)
+	toProto, _ := ptypes.TimestampProto(t)
+
+	client, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Query(context.Background(), &pb.QueryRequest{
+		Name:  *name,
+		Agent: *agent,
+		From:  fromProto,
+		To:    toProto,
+	})
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		m := jsonpb.Marshaler{Indent: "  "}
+		if err := m.Marshal(os.Stdout, res); err != nil {
+			return err
+		}
+
+		fmt.Println()
+
+		return nil
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(pointHeader(res))
+
+		for _, s := range res.Series {
+			for _, p := range s.Points {
+				w.Write(pointRow(s, p))
+			}
+		}
+
+		w.Flush()
+
+		return w.Error()
+
+	case "table":
+		resolution, _ := ptypes.Duration(res.Resolution)
+		fmt.Println("resolution:", resolution)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(pointHeader(res), "\t")))
+
+		for _, s := range res.Series {
+			for _, p := range s.Points {
+				fmt.Fprintln(w, strings.Join(pointRow(s, p), "\t"))
+			}
+		}
+
+		return w.Flush()
+	}
+
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+// pointHeader names the columns of pointRow, with the percentiles of the
+// aggregates last.
+func pointHeader(res *pb.QueryResponse) []string {
+	header := []string{"time", "name", "agent", "type", "count", "sum", "min", "max", "avg", "last"}
+
+	for _, p := range res.Percentiles {
+		header = append(header, "p"+strconv.FormatFloat(p, 'g', -1, 64))
+	}
+
+	return header
+}
+
+func pointRow(s *pb.Series, p *pb.Point) []string {
+	t, _ := ptypes.Timestamp(p.Time)
+
+	avg := 0.0
+	if p.Count > 0 {
+		avg = p.Sum / float64(p.Count)
+	}
+
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	row := []string{formatTime(t), s.Name, s.Agent, s.Type, strconv.FormatInt(p.Count, 10), f(p.Sum), f(p.Min), f(p.Max), f(avg), f(p.Last)}
+
+	for _, v := range p.Percentiles {
+		row = append(row, f(v))
+	}
+
+	return row
+}
+
+func runPush(args []string) error {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	addr := flags.String("addr", defaultAddr, "server address")
+	hostname, _ := os.Hostname()
+	session := flags.String("agent", "gelctl-"+hostname, "agent session the value is pushed as")
+	level := flags.String("level", "info", "level of a log")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gelctl push [flags] counter|gauge name value")
+		fmt.Fprintln(os.Stderr, "       gelctl push [flags] log template [parameters...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	now, _ := ptypes.TimestampProto(time.Now())
+	r := &pb.Record{
+		Ts:      now,
+		Start:   now,
+		End:     now,
+		Session: *session,
+	}
+
+	switch args[0] {
+	case "counter", "gauge":
+		if len(args) != 3 {
+			flags.Usage()
+			os.Exit(2)
+		}
+
+		if args[0] == "counter" {
+			v, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return err
+			}
+
+			r.Numbers = map[string]int64{args[1]: v}
+		} else {
+			v, err := strconv.ParseFloat(args[2], 64)
+			if err != nil {
+				return err
+			}
+
+			r.Instants = map[string]float64{args[1]: v}
+		}
+
+	case "log":
+		lv, err := parseLevel(*level)
+		if err != nil {
+			return err
+		}
+
+		r.Logs = map[string]*pb.Logs{
+			args[1]: {
+				Logs: []*pb.Message{
+					{
+						Parameters: args[2:],
+						Level:      lv,
+					},
+				},
+			},
+		}
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.SyncRecord(context.Background(), r)
+
+	return err
+}
+
+func runAgents(args []string) error {
+	flags := flag.NewFlagSet("agents", flag.ExitOnError)
+	addr := flags.String("addr", defaultAddr, "server address")
+	flags.Parse(args)
+
+	client, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Agents(context.Background(), &pb.AgentsRequest{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tADDRESS\tRELAY\tLAST SEEN\tAGO\tRECORDS\tLAST SEQ")
+
+	for _, a := range res.Agents {
+		t, _ := ptypes.Timestamp(a.LastSeen)
+
+		relay := a.Relay
+		if relay == "" {
+			relay = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", a.Session, a.Address, relay, formatTime(t), time.Since(t).Round(time.Second), a.Records, a.LastSeq)
+	}
+
+	return w.Flush()
+}
+
+func runTemplates(args []string) error {
+	flags := flag.NewFlagSet("templates", flag.ExitOnError)
+	addr := flags.String("addr", defaultAddr, "server address")
+	agent := flags.String("agent", "", "agent session")
+	window := flags.Duration("window", time.Hour, "window compared with the one before")
+	limit := flags.Int("limit", 10, "templates per list")
+	flags.Parse(args)
+
+	client, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Templates(context.Background(), &pb.TemplatesRequest{
+		Agent:  *agent,
+		Window: ptypes.DurationProto(*window),
+		Limit:  int32(*limit),
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "GROWING\tMESSAGES\tBEFORE\tGROWTH")
+	for _, t := range res.Growing {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%+.0f%%\n", t.Template, t.Count, t.Previous, t.Growth*100)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "NEW\tMESSAGES\tFIRST SEEN\t")
+	for _, t := range res.Appeared {
+		first, _ := ptypes.Timestamp(t.FirstSeen)
+		fmt.Fprintf(w, "%s\t%d\t%s\t\n", t.Template, t.Count, formatTime(first))
+	}
+
+	return w.Flush()
+}
+
+func runParameters(args []string) error {
+	flags := flag.NewFlagSet("parameters", flag.ExitOnError)
+	addr := flags.String("addr", defaultAddr, "server address")
+	limit := flags.Int("limit", 10, "values per position")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: gelctl parameters [-limit n] template")
+	}
+
+	client, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Parameters(context.Background(), &pb.ParametersRequest{
+		Template: flags.Arg(0),
+		Limit:    int32(*limit),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("messages:", res.Messages)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tVALUE\tCOUNT\tSHARE")
+
+	for i, p := range res.Positions {
+		bound := ""
+		if p.Truncated {
+			bound = "<="
+		}
+
+		for _, v := range p.Values {
+			fmt.Fprintf(w, "%d\t%s\t%s%d\t%.1f%%\n", i+1, v.Value, bound, v.Count, 100*float64(v.Count)/float64(p.Total))
+		}
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/duanckham/gel/agent"
+	"github.com/duanckham/gel/server"
+)
+
+// duration reads a time.Duration from a string such as "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+
+	return nil
+}
+
+type config struct {
+	Port         int32          `json:"port"`
+	HTTPAddr     string         `json:"http_addr"`
+	Dashboard    bool           `json:"dashboard"`
+	Tokens       []string       `json:"tokens"`
+	DataDir      string         `json:"data_dir"`
+	BucketWidth  duration       `json:"bucket_width"`
+	Grace        duration       `json:"grace"`
+	Percentiles  []float64      `json:"percentiles"`
+	DedupeWindow uint64         `json:"dedupe_window"`
+	Retention    []tierConfig   `json:"retention"`
+	RuleInterval duration       `json:"rule_interval"`
+	Rules        []ruleConfig   `json:"rules"`
+	Notifiers    []notifyConfig `json:"notifiers"`
+	Silences     []silence      `json:"silences"`
+	Relay        *relayConfig   `json:"relay"`
+}
+
+type tierConfig struct {
+	Resolution duration `json:"resolution"`
+	Retention  duration `json:"retention"`
+}
+
+type ruleConfig struct {
+	Name   string   `json:"name"`
+	Kind   string   `json:"kind"`
+	Series string   `json:"series"`
+	Agent  string   `json:"agent"`
+	Window duration `json:"window"`
+	Reduce string   `json:"reduce"`
+	Op     string   `json:"op"`
+	Value  float64  `json:"value"`
+	For    duration `json:"for"`
+	Repeat duration `json:"repeat"`
+}
+
+type notifyConfig struct {
+	// Type is "webhook", "slack" or "smtp".
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Template string `json:"template"`
+
+	SMTP struct {
+		Addr     string   `json:"addr"`
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		From     string   `json:"from"`
+		To       []string `json:"to"`
+	} `json:"smtp"`
+
+	Attempts int      `json:"attempts"`
+	Backoff  duration `json:"backoff"`
+	// RateLimit notifications per RatePer, an hour by default.
+	RateLimit int      `json:"rate_limit"`
+	RatePer   duration `json:"rate_per"`
+	GroupWait duration `json:"group_wait"`
+}
+
+type relayConfig struct {
+	// Upstream is the "host:port" of the gel server records are forwarded to.
+	Upstream    string   `json:"upstream"`
+	Token       string   `json:"token"`
+	Compression string   `json:"compression"`
+	Aggregate   duration `json:"aggregate"`
+	Session     string   `json:"session"`
+	SpoolLimit  int      `json:"spool_limit"`
+}
+
+type silence struct {
+	Rule    string    `json:"rule"`
+	Series  string    `json:"series"`
+	Agent   string    `json:"agent"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Comment string    `json:"comment"`
+}
+
+func loadConfig(path string) (*config, error) {
+	c := &config{
+		Port: 5024,
+	}
+
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// options translates c to the server options, the ones left out keep their
+// default.
+func (c *config) options() ([]server.Option, error) {
+	opts := []server.Option{}
+
+	if c.DataDir != "" {
+		opts = append(opts, server.WithDataDir(c.DataDir))
+	}
+
+	if len(c.Tokens) > 0 {
+		opts = append(opts, server.WithTokens(c.Tokens...))
+	}
+
+	if c.Dashboard {
+		opts = append(opts, server.WithDashboard())
+	}
+
+	if c.BucketWidth > 0 {
+		opts = append(opts, server.WithBucketWidth(time.Duration(c.BucketWidth)))
+	}
+
+	if c.Grace > 0 {
+		opts = append(opts, server.WithGrace(time.Duration(c.Grace)))
+	}
+
+	if len(c.Percentiles) > 0 {
+		opts = append(opts, server.WithPercentiles(c.Percentiles...))
+	}
+
+	if c.DedupeWindow > 0 {
+		opts = append(opts, server.WithDedupeWindow(c.DedupeWindow))
+	}
+
+	if len(c.Retention) > 0 {
+		tiers := []server.Tier{}
+		for _, t := range c.Retention {
+			tiers = append(tiers, server.Tier{
+				Resolution: time.Duration(t.Resolution),
+				Retention:  time.Duration(t.Retention),
+			})
+		}
+
+		opts = append(opts, server.WithRetention(tiers...))
+	}
+
+	if c.RuleInterval > 0 {
+		opts = append(opts, server.WithRuleInterval(time.Duration(c.RuleInterval)))
+	}
+
+	for _, r := range c.Rules {
+		opts = append(opts, server.WithRules(server.Rule{
+			Name:   r.Name,
+			Kind:   server.RuleKind(r.Kind),
+			Series: r.Series,
+			Agent:  r.Agent,
+			Window: time.Duration(r.Window),
+			Reduce: r.Reduce,
+			Op:     r.Op,
+			Value:  r.Value,
+			For:    time.Duration(r.For),
+			Repeat: time.Duration(r.Repeat),
+		}))
+	}
+
+	for _, n := range c.Notifiers {
+		notifier, err := c.notifier(n)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, server.WithNotifier(notifier))
+	}
+
+	if c.Relay != nil {
+		opts = append(opts, server.WithRelay(c.Relay.Upstream, c.Relay.options()...))
+	}
+
+	return opts, nil
+}
+
+func (r *relayConfig) options() []server.RelayOption {
+	opts := []server.RelayOption{}
+
+	if r.Aggregate > 0 {
+		opts = append(opts, server.WithAggregation(time.Duration(r.Aggregate)))
+	}
+
+	if r.Session != "" {
+		opts = append(opts, server.WithRelaySession(r.Session))
+	}
+
+	if r.SpoolLimit > 0 {
+		opts = append(opts, server.WithSpoolLimit(r.SpoolLimit))
+	}
+
+	upstream := []agent.Option{}
+
+	if r.Token != "" {
+		upstream = append(upstream, agent.WithToken(r.Token))
+	}
+
+	if r.Compression != "" {
+		upstream = append(upstream, agent.WithCompression(r.Compression))
+	}
+
+	return append(opts, server.WithUpstreamOptions(upstream...))
+}
+
+func (c *config) notifier(n notifyConfig) (server.Notifier, error) {
+	var target server.Target
+	var err error
+
+	switch n.Type {
+	case "webhook":
+		target, err = server.NewWebhook(n.URL, n.Template)
+	case "slack":
+		target, err = server.NewSlack(n.URL, n.Template)
+	case "smtp":
+		target, err = server.NewSMTP(server.SMTPConfig{
+			Addr:     n.SMTP.Addr,
+			Username: n.SMTP.Username,
+			Password: n.SMTP.Password,
+			From:     n.SMTP.From,
+			To:       n.SMTP.To,
+			Template: n.Template,
+		})
+	default:
+		err = fmt.Errorf("unknown notifier type %q", n.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []server.NotifyOption{}
+
+	if n.Attempts > 0 {
+		backoff := server.DefaultNotifyBackoff
+		if n.Backoff > 0 {
+			backoff = time.Duration(n.Backoff)
+		}
+
+		opts = append(opts, server.WithRetry(n.Attempts, backoff))
+	}
+
+	if n.RateLimit > 0 {
+		per := time.Hour
+		if n.RatePer > 0 {
+			per = time.Duration(n.RatePer)
+		}
+
+		opts = append(opts, server.WithRateLimit(n.RateLimit, per))
+	}
+
+	if n.GroupWait > 0 {
+		opts = append(opts, server.WithGroupWait(time.Duration(n.GroupWait)))
+	}
+
+	for _, s := range c.Silences {
+		opts = append(opts, server.WithSilence(server.Silence{
+			Rule:    s.Rule,
+			Series:  s.Series,
+			Agent:   s.Agent,
+			Start:   s.Start,
+			End:     s.End,
+			Comment: s.Comment,
+		}))
+	}
+
+	return server.NewNotifier(target, opts...), nil
+}
@@ -0,0 +1,61 @@
+// Command gelctl runs a gel server and talks to one.
+//
+//	gelctl server [-config file] [-port port]
+//	gelctl tail   [-agent session] [-template text] [-metric glob] [-level level] [-types list]
+//	gelctl query  -name glob [-agent session|*] [-from time] [-to time] [-format table|json|csv]
+//	gelctl push   counter|gauge name value
+//	gelctl push   log [-level level] template [parameters...]
+//	gelctl agents
+//	gelctl templates  [-agent session] [-window duration] [-limit n]
+//	gelctl parameters [-limit n] template
+//
+// The client commands reach the server at -addr, 127.0.0.1:5024 by default,
+// with the token found in the GEL_TOKEN environment variable if any.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: gelctl <command> [flags]
+
+commands:
+  server      run a server
+  tail        stream the data ingested by the server
+  query       query the series stored by the server
+  push        send a counter, a gauge or a log
+  agents      list the agents seen by the server
+  templates   list the log templates growing the fastest and the new ones
+  parameters  count the values of the parameters of a log template
+
+run gelctl <command> -h for the flags of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"server":     runServer,
+	"tail":       runTail,
+	"query":      runQuery,
+	"push":       runPush,
+	"agents":     runAgents,
+	"templates":  runTemplates,
+	"parameters": runParameters,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gelctl:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/duanckham/gel/server"
+)
+
+func runServer(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	path := flags.String("config", "", "JSON configuration file")
+	port := flags.Int("port", 0, "port to listen on, overrides the configuration")
+	flags.Parse(args)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		return err
+	}
+
+	if *port > 0 {
+		c.Port = int32(*port)
+	}
+
+	opts, err := c.options()
+	if err != nil {
+		return err
+	}
+
+	if c.HTTPAddr != "" {
+		opts = append(opts, server.WithHTTPAddr(c.HTTPAddr))
+	}
+
+	return server.Serve(c.Port, opts...)
+}
@@ -0,0 +1,77 @@
+// Package compressor registers the zstd gRPC compressor. gzip comes with
+// grpc-go, both are registered when this package is imported.
+package compressor
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+// Names of the compressors.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// maxDecodedSize bounds the memory a single message may decode to.
+const maxDecodedSize = 64 << 20
+
+func init() {
+	// Both are safe for concurrent use through EncodeAll and DecodeAll.
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+
+	encoding.RegisterCompressor(&zstdCompressor{
+		encoder: encoder,
+		decoder: decoder,
+	})
+}
+
+// zstdCompressor compresses whole messages, gRPC hands them over in one
+// piece anyway.
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+type zstdWriter struct {
+	bytes.Buffer
+	w       io.Writer
+	encoder *zstd.Encoder
+}
+
+// Close compresses the buffered message to the underlying writer.
+func (z *zstdWriter) Close() error {
+	_, err := z.w.Write(z.encoder.EncodeAll(z.Bytes(), nil))
+	return err
+}
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &zstdWriter{
+		w:       w,
+		encoder: c.encoder,
+	}, nil
+}
+
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := c.decoder.DecodeAll(b, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(out), nil
+}
+
+func (c *zstdCompressor) Name() string {
+	return Zstd
+}
@@ -29,6 +29,8 @@ func runServer() {
 func runAgent() {
 	g := agent.New("127.0.0.1", 5024, time.Duration(5)*time.Second)
 
+	gel.CollectRuntime(g, time.Duration(5)*time.Second)
+
 	testing(g)
 
 	select {}
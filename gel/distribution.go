@@ -0,0 +1,84 @@
+package gel
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DefaultLatencyBuckets are upper bounds in microseconds, from 500us to 10s.
+var DefaultLatencyBuckets = []float64{
+	500, 1000, 2500, 5000, 10000, 25000, 50000,
+	100000, 250000, 500000, 1000000, 2500000, 5000000, 10000000,
+}
+
+// DefaultSizeBuckets are upper bounds in bytes, from 64B to 16MB.
+var DefaultSizeBuckets = []float64{
+	64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216,
+}
+
+// TaggedName joins a metric name and key/value tag pairs as
+// "name{k1=v1,k2=v2}". Tags keep the given order so the same call always
+// yields the same series. A trailing key without value is dropped.
+func TaggedName(name string, tags ...string) string {
+	if len(tags) < 2 {
+		return name
+	}
+
+	b := strings.Builder{}
+	b.WriteString(name)
+	b.WriteByte('{')
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(tags[i])
+		b.WriteByte('=')
+		b.WriteString(tags[i+1])
+	}
+
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// SplitTags undoes TaggedName, it returns the name and its key/value tag
+// pairs, none for a name without tags.
+func SplitTags(name string) (string, []string) {
+	i := strings.IndexByte(name, '{')
+	if i < 0 || !strings.HasSuffix(name, "}") {
+		return name, nil
+	}
+
+	tags := []string{}
+
+	for _, pair := range strings.Split(name[i+1:len(name)-1], ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		tags = append(tags, kv[0], kv[1])
+	}
+
+	return name[:i], tags
+}
+
+// Observe records value into the distribution name. It increments the count
+// of the first bucket whose upper bound holds value ("le=+Inf" past the last
+// one), plus the name.count and name.sum series. Buckets are not cumulative.
+func Observe(g Gel, name string, value float64, buckets []float64, tags ...string) {
+	le := "+Inf"
+
+	for _, b := range buckets {
+		if value <= b {
+			le = strconv.FormatFloat(b, 'f', -1, 64)
+			break
+		}
+	}
+
+	g.Increment(TaggedName(name+".bucket", append(tags[:len(tags):len(tags)], "le", le)...), 1)
+	g.Increment(TaggedName(name+".count", tags...), 1)
+	g.Increment(TaggedName(name+".sum", tags...), int64(value))
+}
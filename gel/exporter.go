@@ -0,0 +1,489 @@
+package gel
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// TriggerExporter is the name of the exporter set by SetTrigger.
+const TriggerExporter = "trigger"
+
+// ExporterErrorsName counts, per exporter, the failed attempts to export a
+// record. The record is retried, with a growing pause, up to the attempts
+// of the exporter, see WithAttempts. It is then dropped, as a record failing
+// with a Permanent error is at once, and counted by QueueDroppedName.
+const ExporterErrorsName = "gel.exporter.errors"
+
+// DefaultExportAttempts is how many times a record is attempted before it
+// is dropped.
+const DefaultExportAttempts = 10
+
+// Exporter receives the records of a Gel.
+type Exporter interface {
+	Export(r *pb.Record) error
+}
+
+// BatchExporter is an Exporter receiving the records by batches, see
+// WithBatching.
+type BatchExporter interface {
+	Exporter
+	ExportBatch(records []*pb.Record) error
+}
+
+// ExporterFunc adapts a function to an Exporter.
+type ExporterFunc func(r *pb.Record) error
+
+// Export calls f(r).
+func (f ExporterFunc) Export(r *pb.Record) error {
+	return f(r)
+}
+
+type permanent struct {
+	err error
+}
+
+func (p permanent) Error() string {
+	return p.err.Error()
+}
+
+func (p permanent) Unwrap() error {
+	return p.err
+}
+
+// Permanent marks err as one retrying would not help with, such as a record
+// refused as invalid. The record failing with it is dropped.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return permanent{err}
+}
+
+// IsPermanent tells whether err was marked by Permanent.
+func IsPermanent(err error) bool {
+	return errors.As(err, &permanent{})
+}
+
+// Filter selects the part of a record an exporter receives. The exporter
+// still receives the records it filters to nothing, with their sequence
+// number.
+type Filter struct {
+	// Types among "number", "instant" and "log", all when empty.
+	Types []string
+	// Prefixes of the metric names and log templates kept, all when empty.
+	Prefixes []string
+}
+
+// ExporterOption configures an exporter.
+type ExporterOption func(*exporter)
+
+// WithFilter sets the filter of an exporter.
+func WithFilter(f Filter) ExporterOption {
+	return func(e *exporter) {
+		e.filter = f
+	}
+}
+
+// WithExporterQueue overrides WithQueue for an exporter.
+func WithExporterQueue(capacity int, policy QueuePolicy) ExporterOption {
+	return func(e *exporter) {
+		if capacity < 1 {
+			capacity = 1
+		}
+
+		e.queueOpts.capacity = capacity
+		e.queueOpts.policy = policy
+	}
+}
+
+// WithAttempts sets how many times a record is attempted before it is
+// dropped, DefaultExportAttempts by default.
+func WithAttempts(n int) ExporterOption {
+	return func(e *exporter) {
+		if n < 1 {
+			n = 1
+		}
+
+		e.attempts = n
+	}
+}
+
+// WithBatching hands the records to a BatchExporter by batches, sent once
+// they reach maxBytes or their first record waited for maxDelay. A batch
+// failing with a Permanent error is attempted again record by record, so
+// only the records refused are dropped.
+func WithBatching(maxBytes int, maxDelay time.Duration) ExporterOption {
+	return func(e *exporter) {
+		e.batchBytes = maxBytes
+		e.batchDelay = maxDelay
+	}
+}
+
+// exporter owns a queue and a sender goroutine, so a slow or failing
+// exporter only ever delays itself.
+type exporter struct {
+	name       string
+	e          Exporter
+	filter     Filter
+	queueOpts  queueOptions
+	queue      *queue
+	attempts   int
+	batchBytes int
+	batchDelay time.Duration
+
+	mu     sync.Mutex
+	errors int64
+}
+
+// run exports the queued records in order. A batch failing is put back at
+// the head of the queue, and a spilled record stays on disk, until it is
+// exported or dropped.
+func (x *exporter) run() {
+	backoff := retryMinBackoff
+	attempts := 0
+
+	for {
+		items := x.next()
+		if len(items) == 0 {
+			return
+		}
+
+		err := x.export(items)
+		if err == nil {
+			x.ack(items)
+			backoff = retryMinBackoff
+			attempts = 0
+			continue
+		}
+
+		x.failed(err)
+
+		if IsPermanent(err) && len(items) > 1 {
+			if !x.exportEach(items) {
+				return
+			}
+
+			attempts = 0
+			continue
+		}
+
+		attempts++
+
+		if IsPermanent(err) || attempts >= x.attempts {
+			fmt.Printf("* gel exporter %s dropped %d records after %d attempts\n", x.name, len(items), attempts)
+
+			for _, it := range items {
+				x.queue.drop(it)
+			}
+
+			attempts = 0
+			continue
+		}
+
+		for i := len(items) - 1; i >= 0; i-- {
+			x.queue.requeue(items[i])
+		}
+
+		if !x.queue.pause(backoff) {
+			return
+		}
+
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// next pops the next record, followed by the ones making its batch when
+// the exporter batches. It returns none once the queue is closed.
+func (x *exporter) next() []*item {
+	it := x.queue.pop()
+	if it == nil {
+		return nil
+	}
+
+	items := []*item{it}
+
+	if _, ok := x.e.(BatchExporter); !ok || x.batchBytes <= 0 {
+		return items
+	}
+
+	size := proto.Size(it.r)
+	deadline := time.Now().Add(x.batchDelay)
+
+	for size < x.batchBytes {
+		it := x.queue.popUntil(deadline)
+		if it == nil {
+			break
+		}
+
+		items = append(items, it)
+		size += proto.Size(it.r)
+	}
+
+	return items
+}
+
+// exportEach exports items one at a time after their batch was refused,
+// dropping the ones refused too. A record failing otherwise is put back
+// with the rest, it returns false if the queue closed meanwhile.
+func (x *exporter) exportEach(items []*item) bool {
+	for i, it := range items {
+		err := x.export([]*item{it})
+
+		switch {
+		case err == nil:
+			x.queue.ack(it)
+
+		case IsPermanent(err):
+			x.failed(err)
+			x.queue.drop(it)
+
+		default:
+			x.failed(err)
+
+			for j := len(items) - 1; j >= i; j-- {
+				x.queue.requeue(items[j])
+			}
+
+			return x.queue.pause(retryMinBackoff)
+		}
+	}
+
+	return true
+}
+
+func (x *exporter) ack(items []*item) {
+	for _, it := range items {
+		x.queue.ack(it)
+	}
+}
+
+func (x *exporter) failed(err error) {
+	fmt.Printf("* gel exporter %s err: %v\n", x.name, err)
+
+	x.mu.Lock()
+	x.errors++
+	x.mu.Unlock()
+}
+
+func (x *exporter) export(items []*item) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	if b, ok := x.e.(BatchExporter); ok && x.batchBytes > 0 {
+		records := make([]*pb.Record, len(items))
+		for i, it := range items {
+			records[i] = it.r
+		}
+
+		return b.ExportBatch(records)
+	}
+
+	return x.e.Export(items[0].r)
+}
+
+func (x *exporter) takeErrors() int64 {
+	defer x.mu.Unlock()
+	x.mu.Lock()
+
+	n := x.errors
+	x.errors = 0
+
+	return n
+}
+
+func (f Filter) hasType(t string) bool {
+	if len(f.Types) == 0 {
+		return true
+	}
+
+	for _, v := range f.Types {
+		if v == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f Filter) hasPrefix(name string) bool {
+	if len(f.Prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range f.Prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply returns the part of r selected by f, in a copy of its own so
+// exporters may change it, every field of r included.
+func (f Filter) apply(r *pb.Record) *pb.Record {
+	out := proto.Clone(r).(*pb.Record)
+
+	if len(f.Types) == 0 && len(f.Prefixes) == 0 {
+		return out
+	}
+
+	for k := range out.Numbers {
+		if !f.hasType("number") || !f.hasPrefix(k) {
+			delete(out.Numbers, k)
+		}
+	}
+
+	for k := range out.Instants {
+		if !f.hasType("instant") || !f.hasPrefix(k) {
+			delete(out.Instants, k)
+		}
+	}
+
+	for k := range out.Logs {
+		if !f.hasType("log") || !f.hasPrefix(k) {
+			delete(out.Logs, k)
+		}
+	}
+
+	return out
+}
+
+// WithExporter registers e under name as AddExporter does, from the first
+// round on.
+func WithExporter(name string, e Exporter, opts ...ExporterOption) Option {
+	return func(g *gi) {
+		g.initial = append(g.initial, func(gel Gel) {
+			gel.AddExporter(name, e, opts...)
+		})
+	}
+}
+
+// AddExporter registers e under name, replacing the exporter of the same
+// name. Each exporter has its own queue, see WithQueue.
+func (g *gi) AddExporter(name string, e Exporter, opts ...ExporterOption) {
+	x := &exporter{
+		name:      name,
+		e:         e,
+		queueOpts: g.queueOpts,
+		attempts:  DefaultExportAttempts,
+	}
+
+	for _, opt := range opts {
+		opt(x)
+	}
+
+	if x.queueOpts.policy == SpillToDisk && x.queueOpts.spillDir == "" {
+		fmt.Println("* gel exporter", name, "has no spill directory, dropping the oldest records instead")
+		x.queueOpts.policy = DropOldest
+	}
+
+	if x.queueOpts.spillDir != "" {
+		x.queueOpts.spillDir = filepath.Join(x.queueOpts.spillDir, name)
+	}
+
+	x.queue = newQueue(x.queueOpts)
+
+	if err := x.queue.recover(); err != nil {
+		// TODO
+		fmt.Println("* gel queue err:", err)
+	}
+
+	g.exportersMu.Lock()
+	old := g.exporters[name]
+	g.exporters[name] = x
+	g.exportersMu.Unlock()
+
+	if old != nil {
+		old.queue.close()
+	}
+
+	go x.run()
+}
+
+// RemoveExporter unregisters the exporter of name, records still queued for
+// it are dropped.
+func (g *gi) RemoveExporter(name string) {
+	g.exportersMu.Lock()
+	x := g.exporters[name]
+	delete(g.exporters, name)
+	g.exportersMu.Unlock()
+
+	if x != nil {
+		x.queue.close()
+	}
+}
+
+// SetTrigger exports every record to f, which cannot fail. An exporter
+// returning its errors is retried, see AddExporter.
+func (g *gi) SetTrigger(f recordsTriggerFunc) {
+	g.AddExporter(TriggerExporter, ExporterFunc(func(r *pb.Record) error {
+		f(r)
+		return nil
+	}))
+}
+
+// wait blocks writers while the queue of an exporter with the Block policy
+// is full.
+func (g *gi) wait() {
+	full := []*queue{}
+
+	g.exportersMu.RLock()
+	for _, x := range g.exporters {
+		if x.queue.isFull() {
+			full = append(full, x.queue)
+		}
+	}
+	g.exportersMu.RUnlock()
+
+	for _, q := range full {
+		q.wait()
+	}
+}
+
+// export queues r for every exporter, with the state of their queues riding
+// along so idle rounds stay empty.
+func (g *gi) export(r *pb.Record) {
+	defer g.exportersMu.RUnlock()
+	g.exportersMu.RLock()
+
+	for name, x := range g.exporters {
+		length, dropped, spilled := x.queue.stats()
+		if errors := x.takeErrors(); errors > 0 {
+			r.Numbers[TaggedName(ExporterErrorsName, "exporter", name)] = errors
+		}
+
+		if length > 0 {
+			r.Instants[TaggedName(QueueLengthName, "exporter", name)] = float64(length)
+		}
+
+		if dropped > 0 {
+			r.Numbers[TaggedName(QueueDroppedName, "exporter", name)] = dropped
+		}
+
+		if spilled > 0 {
+			r.Numbers[TaggedName(QueueSpilledName, "exporter", name)] = spilled
+		}
+	}
+
+	// A record filtered to nothing is still queued, its sequence number
+	// telling the server no record was lost.
+	for _, x := range g.exporters {
+		x.queue.push(x.filter.apply(r))
+	}
+}
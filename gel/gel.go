@@ -2,6 +2,8 @@ package gel
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"strings"
 	"sync"
 	"time"
@@ -16,10 +18,12 @@ import (
 const LogVariablePlaceholder = "??"
 
 type record struct {
-	Ts       time.Time
+	Start    time.Time
+	End      time.Time
 	Numbers  map[string]int64
 	Instants map[string]float64
 	Logs     map[string]*pb.Logs
+	dropped  dropped
 }
 
 type records [3]*record
@@ -31,7 +35,10 @@ type Gel interface {
 	Decrement(name string, value int64)
 	Gauge(name string, value float64)
 	Log(message string, parameters ...interface{})
+	LogLevel(level Level, message string, parameters ...interface{})
 	SetTrigger(recordsTriggerFunc)
+	AddExporter(name string, e Exporter, opts ...ExporterOption)
+	RemoveExporter(name string)
 }
 
 // Gel implement.
@@ -42,17 +49,40 @@ type gi struct {
 	numbersMu  sync.Mutex
 	instantsMu sync.Mutex
 	logsMu     sync.Mutex
-	callback   recordsTriggerFunc
+	limits     Limits
+	aligned    bool
+	session    string
+	seq        uint64
+
+	sampling         *Sampling
+	templateSampling map[string]*Sampling
+	buckets          map[string]*tokenBucket
+
+	queueOpts   queueOptions
+	exportersMu sync.RWMutex
+	exporters   map[string]*exporter
+	initial     []func(Gel)
+	rotations   []func(time.Time)
 }
 
 // New ...
-func New(period time.Duration) Gel {
-	g := &gi{}
+func New(period time.Duration, opts ...Option) Gel {
+	g := &gi{
+		session: newSession(),
+		buckets: map[string]*tokenBucket{},
+		queueOpts: queueOptions{
+			capacity: DefaultQueueCapacity,
+		},
+		exporters: map[string]*exporter{},
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
 
 	g.recordSP = &sync.Pool{
 		New: func() interface{} {
 			return record{
-				Ts:       time.Now(),
 				Numbers:  map[string]int64{},
 				Instants: map[string]float64{},
 				Logs:     map[string]*pb.Logs{},
@@ -67,19 +97,51 @@ func New(period time.Duration) Gel {
 		g.rec[i] = &t
 	}
 
+	g.rec[g.round].Start = time.Now()
+
+	for _, f := range g.initial {
+		f(g)
+	}
+
 	return g.interval(period)
 }
 
 // Increment ..
 func (g *gi) Increment(name string, value int64) {
+	g.wait()
+	g.increment(name, value)
+}
+
+// IncrementNoWait increments name as Increment does, without waiting while
+// the queue of a Block exporter is full. Exporters counting on their own
+// sender must use it, the sender being the one draining the queue.
+func IncrementNoWait(g Gel, name string, value int64) {
+	if g, ok := g.(*gi); ok {
+		g.increment(name, value)
+		return
+	}
+
+	g.Increment(name, value)
+}
+
+func (g *gi) increment(name string, value int64) {
 	defer g.numbersMu.Unlock()
 	g.numbersMu.Lock()
 
-	if v, ok := g.rec[g.round].Numbers[name]; ok {
-		g.rec[g.round].Numbers[name] = v + value
-	} else {
-		g.rec[g.round].Numbers[name] = value
+	r := g.rec[g.round]
+
+	if v, ok := r.Numbers[name]; ok {
+		r.Numbers[name] = v + value
+		return
+	}
+
+	if g.limits.MaxNumbers > 0 && len(r.Numbers) >= g.limits.MaxNumbers {
+		r.dropped.numbers++
+		r.Numbers[OverflowName] += value
+		return
 	}
+
+	r.Numbers[name] = value
 }
 
 // Decrement ..
@@ -89,38 +151,132 @@ func (g *gi) Decrement(name string, value int64) {
 
 // Gauge ...
 func (g *gi) Gauge(name string, value float64) {
+	g.wait()
+
 	defer g.instantsMu.Unlock()
 	g.instantsMu.Lock()
-	g.rec[g.round].Instants[name] = value
+
+	r := g.rec[g.round]
+
+	if _, ok := r.Instants[name]; !ok && g.limits.MaxInstants > 0 && len(r.Instants) >= g.limits.MaxInstants {
+		r.dropped.instants++
+		name = OverflowName
+	}
+
+	r.Instants[name] = value
 }
 
 // Log ...
 func (g *gi) Log(template string, parameters ...interface{}) {
+	g.LogLevel(LevelInfo, template, parameters...)
+}
+
+// LogLevel ...
+func (g *gi) LogLevel(level Level, template string, parameters ...interface{}) {
+	g.wait()
+
 	defer g.logsMu.Unlock()
 	g.logsMu.Lock()
 
-	tsb := g.rec[g.round].Ts
+	r := g.rec[g.round]
+
+	if _, ok := r.Logs[template]; !ok && g.limits.MaxTemplates > 0 && len(r.Logs) >= g.limits.MaxTemplates {
+		r.dropped.templates++
+		parameters = []interface{}{template}
+		template = OverflowTemplate
+	}
+
+	tsb := r.Start
 	now := time.Now()
 
-	m := pb.Message{
-		Parameters: utils.InterfacesToStrings(parameters),
-		Offset:     int64(now.Sub(tsb)),
+	v, ok := r.Logs[template]
+	if !ok {
+		v = &pb.Logs{}
+		r.Logs[template] = v
+	}
+
+	if !g.sample(template, level, int64(len(v.Logs))+v.Suppressed, now) {
+		v.Suppressed++
+		return
+	}
+
+	if g.limits.MaxMessages > 0 && len(v.Logs) >= g.limits.MaxMessages {
+		r.dropped.messages++
+		v.Suppressed++
+		return
 	}
 
-	if v, ok := g.rec[g.round].Logs[template]; ok {
-		v.Logs = append(v.Logs, &m)
+	v.Logs = append(v.Logs, &pb.Message{
+		Parameters: utils.InterfacesToStrings(parameters),
+		Offset:     int64(now.Sub(tsb)),
+		Level:      level,
+	})
+}
 
-		g.rec[g.round].Logs[template] = v
-	} else {
-		g.rec[g.round].Logs[template] = &pb.Logs{
-			Logs: []*pb.Message{&m},
+// MergeLogs adds the messages of logs, taken from a record started at start,
+// to the current round of g under template. Their offsets are moved to the
+// round and they are not sampled a second time, the limits still apply.
+// Suppressed messages add up with the ones of the round.
+func MergeLogs(g Gel, template string, logs *pb.Logs, start time.Time) {
+	x, ok := g.(*gi)
+	if !ok {
+		for _, m := range logs.Logs {
+			g.LogLevel(m.Level, template, utils.StringsToInterfaces(m.Parameters)...)
 		}
+
+		return
 	}
+
+	x.mergeLogs(template, logs, start)
 }
 
-// SetTrigger ...
-func (g *gi) SetTrigger(f recordsTriggerFunc) {
-	g.callback = f
+func (g *gi) mergeLogs(template string, logs *pb.Logs, start time.Time) {
+	g.wait()
+
+	defer g.logsMu.Unlock()
+	g.logsMu.Lock()
+
+	r := g.rec[g.round]
+
+	overflow := ""
+	if _, ok := r.Logs[template]; !ok && g.limits.MaxTemplates > 0 && len(r.Logs) >= g.limits.MaxTemplates {
+		r.dropped.templates++
+		overflow = template
+		template = OverflowTemplate
+	}
+
+	v, ok := r.Logs[template]
+	if !ok {
+		v = &pb.Logs{}
+		r.Logs[template] = v
+	}
+
+	v.Suppressed += logs.Suppressed
+	shift := int64(start.Sub(r.Start))
+
+	for _, m := range logs.Logs {
+		if g.limits.MaxMessages > 0 && len(v.Logs) >= g.limits.MaxMessages {
+			r.dropped.messages++
+			v.Suppressed++
+			continue
+		}
+
+		offset := m.Offset + shift
+		if offset < 0 {
+			offset = 0
+		}
+
+		parameters := m.Parameters
+		if overflow != "" {
+			parameters = []string{overflow}
+		}
+
+		v.Logs = append(v.Logs, &pb.Message{
+			Parameters: parameters,
+			Offset:     offset,
+			Level:      m.Level,
+		})
+	}
 }
 
 // Dump ...
@@ -129,16 +285,25 @@ func (g *gi) dump() (*pb.Record, error) {
 	l := (g.round + 1) % 3
 	r := g.rec[l]
 
-	ts, err := ptypes.TimestampProto(r.Ts)
+	r.dropped.report(r.Numbers)
+
+	start, err := ptypes.TimestampProto(r.Start)
+	if err != nil {
+		// TODO
+	}
+
+	end, err := ptypes.TimestampProto(r.End)
 	if err != nil {
 		// TODO
 	}
 
 	p := pb.Record{
-		Ts:       ts,
+		Ts:       start,
 		Numbers:  r.Numbers,
 		Instants: r.Instants,
 		Logs:     r.Logs,
+		Start:    start,
+		End:      end,
 	}
 
 	t := g.recordSP.Get().(record)
@@ -147,46 +312,113 @@ func (g *gi) dump() (*pb.Record, error) {
 	return &p, nil
 }
 
+// reap queues the landing round for the exporters, their senders hand it
+// over so a slow exporter never delays the rotation.
 func (g *gi) reap() {
 	r, err := g.dump()
 	if err != nil {
 		// TODO
 	}
 
+	g.pruneBuckets(time.Now())
+
 	if len(r.Numbers) == 0 && len(r.Instants) == 0 && len(r.Logs) == 0 {
 		return
 	}
 
-	g.callback(r)
+	// Only records sent are numbered, a gap means a lost record.
+	g.seq++
+	r.Session = g.session
+	r.Seq = g.seq
+
+	g.export(r)
+}
+
+// rotate closes the current round and opens the next one at boundary. The
+// next round starts before writers can see it.
+func (g *gi) rotate(boundary time.Time) {
+	next := (g.round + 1) % 3
+
+	g.rec[next].Start = boundary
+	g.rec[g.round].End = boundary
+	g.round = next
 }
 
 func (g *gi) interval(period time.Duration) Gel {
 	go func() {
-		t := time.NewTicker(period)
+		next := time.Now().Add(period)
+		if g.aligned {
+			next = time.Now().Truncate(period).Add(period)
+		}
+
+		t := time.NewTimer(time.Until(next))
 		defer t.Stop()
 
 		for {
 			<-t.C
 
-			if g.round == 2 {
-				g.round = 0
-			} else {
-				g.round++
+			g.rotate(next)
+
+			for _, f := range g.rotations {
+				f(next)
 			}
 
 			g.reap()
+
+			// Boundaries missed while the process was stalled are skipped,
+			// the round opened just now covers them.
+			next = next.Add(period)
+			for !next.After(time.Now()) {
+				next = next.Add(period)
+			}
+
+			t.Reset(time.Until(next))
 		}
 	}()
 
 	return g
 }
 
-// RecordUnit is the smallest unit of a record
+// newSession returns a random identifier for a gel instance.
+func newSession() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// FormatLog fills the placeholders of template with parameters, in order.
+// Placeholders left without a parameter are kept, parameters left without
+// a placeholder are dropped.
+func FormatLog(template string, parameters []string) string {
+	segment := strings.Split(template, LogVariablePlaceholder)
+	b := strings.Builder{}
+
+	for i, s := range segment {
+		b.WriteString(s)
+
+		if i == len(segment)-1 {
+			break
+		}
+
+		if i < len(parameters) {
+			b.WriteString(parameters[i])
+		} else {
+			b.WriteString(LogVariablePlaceholder)
+		}
+	}
+
+	return b.String()
+}
+
+// RecordUnit is the smallest unit of a record, K is the template of a log
+// and L its level.
 type RecordUnit struct {
 	T string
 	K string
 	V interface{}
 	D time.Time
+	L Level
 }
 
 // Read ...
@@ -229,25 +461,22 @@ func Read(in *pb.Record) (chan RecordUnit, chan struct{}) {
 
 	controller.Do(func(ctx context.Context) error {
 		for template, logs := range in.Logs {
-			segment := strings.Split(template, LogVariablePlaceholder)
-
-			for _, message := range logs.Logs {
-				t := make([]string, len(segment)+len(message.Parameters))
-
-				for j, parameter := range message.Parameters {
-					t = append(t, segment[j])
-					t = append(t, parameter)
-
-					if j == len(message.Parameters)-1 {
-						t = append(t, segment[j+1:]...)
-					}
+			if logs.Suppressed > 0 {
+				ch <- RecordUnit{
+					T: "suppressed",
+					K: template,
+					V: logs.Suppressed,
+					D: date,
 				}
+			}
 
+			for _, message := range logs.Logs {
 				ch <- RecordUnit{
 					T: "log",
-					K: "",
-					V: strings.Join(t, ""),
+					K: template,
+					V: FormatLog(template, message.Parameters),
 					D: date.Add(time.Duration(message.Offset)),
+					L: message.Level,
 				}
 			}
 		}
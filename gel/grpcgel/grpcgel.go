@@ -0,0 +1,254 @@
+// Package grpcgel instruments gRPC servers and clients with gel metrics.
+//
+// Server side series, tagged with the full method and the status code:
+//
+//	grpc.server.requests
+//	grpc.server.latency_us.{bucket,count,sum}
+//	grpc.server.received_bytes.{bucket,count,sum}
+//	grpc.server.sent_bytes.{bucket,count,sum}
+//
+// Latency and message sizes are tagged with the method only. The client
+// side uses the same names under "grpc.client.".
+package grpcgel
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/duanckham/gel/gel"
+)
+
+// Metric name prefixes.
+const (
+	ServerPrefix = "grpc.server."
+	ClientPrefix = "grpc.client."
+)
+
+// DefaultErrorLog is the failed call template, its parameters are the full
+// method, the status code and the status message, in this order.
+const DefaultErrorLog = "grpc ?? failed code=?? message=??"
+
+type options struct {
+	latencyBuckets []float64
+	sizeBuckets    []float64
+	errorLog       string
+}
+
+// Option configures the interceptors.
+type Option func(*options)
+
+// WithLatencyBuckets sets the latency buckets, in microseconds.
+func WithLatencyBuckets(buckets []float64) Option {
+	return func(o *options) {
+		o.latencyBuckets = buckets
+	}
+}
+
+// WithSizeBuckets sets the message size buckets, in bytes.
+func WithSizeBuckets(buckets []float64) Option {
+	return func(o *options) {
+		o.sizeBuckets = buckets
+	}
+}
+
+// WithErrorLog logs failed calls through Gel.Log with template, see
+// DefaultErrorLog for its parameters.
+func WithErrorLog(template string) Option {
+	return func(o *options) {
+		o.errorLog = template
+	}
+}
+
+type instrument struct {
+	g      gel.Gel
+	opts   *options
+	prefix string
+}
+
+func newInstrument(g gel.Gel, prefix string, opts []Option) *instrument {
+	o := &options{
+		latencyBuckets: gel.DefaultLatencyBuckets,
+		sizeBuckets:    gel.DefaultSizeBuckets,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return &instrument{
+		g:      g,
+		opts:   o,
+		prefix: prefix,
+	}
+}
+
+func (in *instrument) message(name string, method string, m interface{}) {
+	if pm, ok := m.(proto.Message); ok {
+		gel.Observe(in.g, in.prefix+name, float64(proto.Size(pm)), in.opts.sizeBuckets, "method", method)
+	}
+}
+
+func (in *instrument) done(method string, start time.Time, err error) {
+	s := status.Convert(err)
+	code := s.Code().String()
+
+	in.g.Increment(gel.TaggedName(in.prefix+"requests", "method", method, "code", code), 1)
+	gel.Observe(in.g, in.prefix+"latency_us", float64(time.Since(start).Microseconds()), in.opts.latencyBuckets, "method", method)
+
+	if err != nil && in.opts.errorLog != "" {
+		in.g.LogLevel(gel.LevelError, in.opts.errorLog, method, code, s.Message())
+	}
+}
+
+// UnaryServerInterceptor records unary calls handled by a server.
+func UnaryServerInterceptor(g gel.Gel, opts ...Option) grpc.UnaryServerInterceptor {
+	in := newInstrument(g, ServerPrefix, opts)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+
+		in.message("received_bytes", info.FullMethod, req)
+
+		res, err := handler(ctx, req)
+		if err == nil {
+			in.message("sent_bytes", info.FullMethod, res)
+		}
+
+		in.done(info.FullMethod, start, err)
+
+		return res, err
+	}
+}
+
+// StreamServerInterceptor records streams handled by a server, each message
+// is counted in the size distributions.
+func StreamServerInterceptor(g gel.Gel, opts ...Option) grpc.StreamServerInterceptor {
+	in := newInstrument(g, ServerPrefix, opts)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+
+		err := handler(srv, &serverStream{
+			ServerStream: ss,
+			in:           in,
+			method:       info.FullMethod,
+		})
+
+		in.done(info.FullMethod, start, err)
+
+		return err
+	}
+}
+
+// UnaryClientInterceptor records unary calls made by a client.
+func UnaryClientInterceptor(g gel.Gel, opts ...Option) grpc.UnaryClientInterceptor {
+	in := newInstrument(g, ClientPrefix, opts)
+
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		start := time.Now()
+
+		in.message("sent_bytes", method, req)
+
+		err := invoker(ctx, method, req, reply, cc, callOpts...)
+		if err == nil {
+			in.message("received_bytes", method, reply)
+		}
+
+		in.done(method, start, err)
+
+		return err
+	}
+}
+
+// StreamClientInterceptor records streams opened by a client. The call is
+// done when RecvMsg fails, io.EOF included, or when it returns the single
+// response of a stream the server does not stream on.
+func StreamClientInterceptor(g gel.Gel, opts ...Option) grpc.StreamClientInterceptor {
+	in := newInstrument(g, ClientPrefix, opts)
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+
+		cs, err := streamer(ctx, desc, cc, method, callOpts...)
+		if err != nil {
+			in.done(method, start, err)
+			return nil, err
+		}
+
+		return &clientStream{
+			ClientStream: cs,
+			in:           in,
+			method:       method,
+			start:        start,
+			single:       !desc.ServerStreams,
+		}, nil
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	in     *instrument
+	method string
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.in.message("sent_bytes", s.method, m)
+	}
+
+	return err
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.in.message("received_bytes", s.method, m)
+	}
+
+	return err
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	in     *instrument
+	method string
+	start  time.Time
+	single bool
+	ended  bool
+}
+
+func (s *clientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.in.message("sent_bytes", s.method, m)
+	}
+
+	return err
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.in.message("received_bytes", s.method, m)
+	}
+
+	if s.ended || (err == nil && !s.single) {
+		return err
+	}
+
+	s.ended = true
+
+	if err == io.EOF {
+		s.in.done(s.method, s.start, nil)
+	} else {
+		s.in.done(s.method, s.start, err)
+	}
+
+	return err
+}
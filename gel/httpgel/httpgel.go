@@ -0,0 +1,332 @@
+// Package httpgel instruments net/http servers and clients with gel metrics.
+//
+// Server side series, tagged with method, route and status:
+//
+//	http.server.requests
+//	http.server.latency_us.{bucket,count,sum}
+//	http.server.in_flight
+//
+// The client side uses the same names under "http.client." with an extra
+// host tag. Routes and hosts are normalized and capped so a path carrying
+// ids cannot blow up the number of series. A handler panicking is recorded
+// with the 500 status, a request whose connection the handler hijacks, a
+// WebSocket for instance, with HijackedStatus.
+package httpgel
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duanckham/gel/gel"
+)
+
+// Metric name prefixes.
+const (
+	ServerPrefix = "http.server."
+	ClientPrefix = "http.client."
+)
+
+// HijackedStatus is the status of the requests whose connection was
+// hijacked, no status being written on them.
+const HijackedStatus = "hijacked"
+
+// OtherRoute replaces routes past the cardinality limit.
+const OtherRoute = "other"
+
+// DefaultAccessLog is the access log template, its parameters are method,
+// path, status and latency in microseconds, in this order. Failed requests
+// and 5xx responses are logged at gel.LevelError.
+const DefaultAccessLog = "http ?? ?? status=?? latency=??us"
+
+// DefaultMaxRoutes bounds the number of distinct routes per handler.
+const DefaultMaxRoutes = 200
+
+type options struct {
+	route     func(r *http.Request) string
+	maxRoutes int
+	buckets   []float64
+	accessLog string
+}
+
+// Option configures the middleware and the transport.
+type Option func(*options)
+
+// WithRoute sets the function naming the route of a request, for example
+// from the router's matched pattern. It defaults to NormalizePath.
+func WithRoute(f func(r *http.Request) string) Option {
+	return func(o *options) {
+		o.route = f
+	}
+}
+
+// WithMaxRoutes sets how many distinct routes, and hosts on the client side,
+// are tracked before new ones are folded into OtherRoute.
+func WithMaxRoutes(n int) Option {
+	return func(o *options) {
+		o.maxRoutes = n
+	}
+}
+
+// WithBuckets sets the latency buckets, in microseconds.
+func WithBuckets(buckets []float64) Option {
+	return func(o *options) {
+		o.buckets = buckets
+	}
+}
+
+// WithAccessLog enables the access log through Gel.Log with template, see
+// DefaultAccessLog for its parameters.
+func WithAccessLog(template string) Option {
+	return func(o *options) {
+		o.accessLog = template
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		route: func(r *http.Request) string {
+			return NormalizePath(r.URL.Path)
+		},
+		maxRoutes: DefaultMaxRoutes,
+		buckets:   gel.DefaultLatencyBuckets,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// routes keeps the set of routes seen and enforces the cardinality limit.
+type routes struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func (rs *routes) bound(route string) string {
+	defer rs.mu.Unlock()
+	rs.mu.Lock()
+
+	if _, ok := rs.seen[route]; ok {
+		return route
+	}
+
+	if len(rs.seen) >= rs.max {
+		return OtherRoute
+	}
+
+	rs.seen[route] = struct{}{}
+
+	return route
+}
+
+var (
+	hexID  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	uuidID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	number = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// NormalizePath replaces path segments that look like identifiers (numbers,
+// UUIDs and long hex strings) with ":id".
+func NormalizePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+
+	for i, s := range segments {
+		if number.MatchString(s) || uuidID.MatchString(s) || hexID.MatchString(s) {
+			segments[i] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+type instrument struct {
+	g        gel.Gel
+	opts     *options
+	prefix   string
+	routes   *routes
+	hosts    *routes
+	inFlight int64
+}
+
+func newInstrument(g gel.Gel, prefix string, opts []Option) *instrument {
+	o := newOptions(opts)
+
+	return &instrument{
+		g:      g,
+		opts:   o,
+		prefix: prefix,
+		routes: &routes{
+			max:  o.maxRoutes,
+			seen: map[string]struct{}{},
+		},
+		hosts: &routes{
+			max:  o.maxRoutes,
+			seen: map[string]struct{}{},
+		},
+	}
+}
+
+func (in *instrument) begin() {
+	in.g.Gauge(in.prefix+"in_flight", float64(atomic.AddInt64(&in.inFlight, 1)))
+}
+
+func (in *instrument) end(r *http.Request, status string, start time.Time, tags ...string) {
+	in.g.Gauge(in.prefix+"in_flight", float64(atomic.AddInt64(&in.inFlight, -1)))
+
+	latency := time.Since(start).Microseconds()
+	route := in.routes.bound(in.opts.route(r))
+	tags = append(tags, "method", r.Method, "route", route, "status", status)
+
+	in.g.Increment(gel.TaggedName(in.prefix+"requests", tags...), 1)
+	gel.Observe(in.g, in.prefix+"latency_us", float64(latency), in.opts.buckets, tags...)
+
+	if in.opts.accessLog != "" {
+		level := gel.LevelInfo
+		if code, _ := strconv.Atoi(status); code >= 500 || status == "error" {
+			level = gel.LevelError
+		}
+
+		in.g.LogLevel(level, in.opts.accessLog, r.Method, r.URL.Path, status, strconv.FormatInt(latency, 10))
+	}
+}
+
+// Middleware returns a server middleware recording every request into g.
+func Middleware(g gel.Gel, opts ...Option) func(http.Handler) http.Handler {
+	in := newInstrument(g, ServerPrefix, opts)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+
+			in.begin()
+			defer func() {
+				if p := recover(); p != nil {
+					in.end(r, strconv.Itoa(http.StatusInternalServerError), start)
+					panic(p)
+				}
+
+				in.end(r, sw.status(), start)
+			}()
+
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// Handler wraps next with Middleware.
+func Handler(g gel.Gel, next http.Handler, opts ...Option) http.Handler {
+	return Middleware(g, opts...)(next)
+}
+
+// statusWriter remembers the status code written by the handler.
+type statusWriter struct {
+	http.ResponseWriter
+	code     int
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher when the underlying writer does.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker when the underlying writer does.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) status() string {
+	switch {
+	case w.hijacked:
+		return HijackedStatus
+	case w.code == 0:
+		return strconv.Itoa(http.StatusOK)
+	}
+
+	return strconv.Itoa(w.code)
+}
+
+// Transport is an http.RoundTripper recording every request into a Gel.
+type Transport struct {
+	Base http.RoundTripper
+	in   *instrument
+}
+
+// NewTransport returns a Transport over base, http.DefaultTransport if nil.
+func NewTransport(g gel.Gel, base http.RoundTripper, opts ...Option) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{
+		Base: base,
+		in:   newInstrument(g, ClientPrefix, opts),
+	}
+}
+
+// RoundTrip implements http.RoundTripper. Failed requests get the "error"
+// status.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	status := "error"
+
+	t.in.begin()
+	defer func() {
+		t.in.end(r, status, start, "host", t.in.hosts.bound(r.URL.Host))
+	}()
+
+	res, err := t.Base.RoundTrip(r)
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+
+	return res, err
+}
@@ -0,0 +1,52 @@
+package gel
+
+// Sentinels receiving what does not fit in the limits of a round.
+const (
+	OverflowName     = "gel.overflow"
+	OverflowTemplate = "gel.overflow ??"
+)
+
+// DroppedName counts, per kind, the entries of a round that were folded into
+// the overflow sentinels or dropped. It is reported as a number of the record
+// tagged with kind "numbers", "instants", "templates" or "messages".
+const DroppedName = "gel.dropped"
+
+// Limits bounds what a single round may hold, zero meaning unlimited.
+//
+// A new metric name past MaxNumbers or MaxInstants is folded into
+// OverflowName. A new template past MaxTemplates is logged through
+// OverflowTemplate with the original template as its parameter, and messages
+// past MaxMessages for a template are dropped.
+type Limits struct {
+	MaxNumbers   int
+	MaxInstants  int
+	MaxTemplates int
+	MaxMessages  int
+}
+
+// dropped counts overflow per round, each field is guarded by the mutex of
+// its kind.
+type dropped struct {
+	numbers   int64
+	instants  int64
+	templates int64
+	messages  int64
+}
+
+func (d *dropped) report(numbers map[string]int64) {
+	kinds := []struct {
+		kind string
+		n    int64
+	}{
+		{"numbers", d.numbers},
+		{"instants", d.instants},
+		{"templates", d.templates},
+		{"messages", d.messages},
+	}
+
+	for _, k := range kinds {
+		if k.n > 0 {
+			numbers[TaggedName(DroppedName, "kind", k.kind)] = k.n
+		}
+	}
+}
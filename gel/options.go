@@ -0,0 +1,30 @@
+package gel
+
+import "time"
+
+// Option configures a Gel.
+type Option func(*gi)
+
+// WithLimits bounds the cardinality of every round, see Limits.
+func WithLimits(l Limits) Option {
+	return func(g *gi) {
+		g.limits = l
+	}
+}
+
+// WithRotation calls f every time a round starts, with its start, before
+// the round just closed is exported.
+func WithRotation(f func(start time.Time)) Option {
+	return func(g *gi) {
+		g.rotations = append(g.rotations, f)
+	}
+}
+
+// WithAlignment aligns the rounds on multiples of the period on the wall
+// clock, so agents sharing a period cover the same intervals. The first
+// round is shorter, it ends on the first boundary.
+func WithAlignment() Option {
+	return func(g *gi) {
+		g.aligned = true
+	}
+}
@@ -0,0 +1,426 @@
+// Package otlpgel exports the records of a gel.Gel to an OpenTelemetry
+// collector, or any OTLP/gRPC receiver:
+//
+//	conn, err := grpc.Dial("collector:4317", grpc.WithInsecure())
+//	g := gel.New(period, gel.WithExporter("otlp", otlpgel.New(conn, otlpgel.WithServiceName("api"))))
+//
+// or next to a gel server, with agent.WithGel.
+//
+// Numbers are exported as delta sums and instants as gauges, the tags of
+// their names as attributes. Logs are exported as log records whose body is
+// the formatted message, with the template and the parameters in the
+// gel.template and gel.parameters attributes, so a gel server receiving
+// them over OTLP keeps their template. Messages suppressed are counted in
+// the SuppressedName sum, tagged with the template. Data the receiver
+// rejects, in part or as invalid, is dropped rather than retried.
+package otlpgel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/duanckham/gel/gel"
+	"github.com/duanckham/gel/pb"
+)
+
+// Attributes of the log records carrying the template and the parameters.
+const (
+	TemplateAttribute   = "gel.template"
+	ParametersAttribute = "gel.parameters"
+)
+
+// SuppressedName is the sum of the messages suppressed, per template.
+const SuppressedName = "gel.log.suppressed"
+
+// DefaultServiceName is the service.name of the resource unless
+// WithServiceName sets it.
+const DefaultServiceName = "gel"
+
+// DefaultTimeout bounds every export call.
+const DefaultTimeout = 10 * time.Second
+
+// scope names the instrumentation scope of the data exported.
+const scope = "github.com/duanckham/gel"
+
+type options struct {
+	serviceName string
+	resource    map[string]string
+	timeout     time.Duration
+}
+
+// Option configures an Exporter.
+type Option func(*options)
+
+// WithServiceName sets the service.name attribute of the resource.
+func WithServiceName(name string) Option {
+	return func(o *options) {
+		o.serviceName = name
+	}
+}
+
+// WithResource adds attributes to the resource, next to service.name and
+// service.instance.id, the latter being the session of the Gel.
+func WithResource(attributes map[string]string) Option {
+	return func(o *options) {
+		if o.resource == nil {
+			o.resource = map[string]string{}
+		}
+
+		for k, v := range attributes {
+			o.resource[k] = v
+		}
+	}
+}
+
+// WithTimeout bounds every export call, DefaultTimeout by default.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// Exporter is a gel.Exporter sending the records over OTLP/gRPC. The
+// metrics and the logs of a record are exported by two calls, a record
+// retried after the logs failed only sends its logs again, so the sums are
+// not counted twice.
+type Exporter struct {
+	metrics colmetricspb.MetricsServiceClient
+	logs    collogspb.LogsServiceClient
+	opts    *options
+
+	mu sync.Mutex
+	// metricsDone is the last record whose metrics were exported, records
+	// being retried in order until exported.
+	metricsDone recordID
+}
+
+type recordID struct {
+	session string
+	seq     uint64
+}
+
+// New returns an Exporter calling the OTLP services over conn.
+func New(conn grpc.ClientConnInterface, opts ...Option) *Exporter {
+	o := &options{
+		serviceName: DefaultServiceName,
+		timeout:     DefaultTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return &Exporter{
+		metrics: colmetricspb.NewMetricsServiceClient(conn),
+		logs:    collogspb.NewLogsServiceClient(conn),
+		opts:    o,
+	}
+}
+
+// Export implements gel.Exporter. Metrics the receiver rejects do not keep
+// the logs from being exported, the error is returned once they are.
+func (e *Exporter) Export(r *pb.Record) error {
+	resource := e.resource(r.Session)
+	id := recordID{r.Session, r.Seq}
+
+	var rejected error
+
+	e.mu.Lock()
+	done := e.metricsDone == id
+	e.mu.Unlock()
+
+	if !done {
+		err := e.exportMetrics(resource, r)
+		if err != nil && !gel.IsPermanent(err) {
+			return err
+		}
+
+		rejected = err
+
+		e.mu.Lock()
+		e.metricsDone = id
+		e.mu.Unlock()
+	}
+
+	if err := e.exportLogs(resource, r); err != nil {
+		return err
+	}
+
+	return rejected
+}
+
+func (e *Exporter) exportMetrics(resource *resourcepb.Resource, r *pb.Record) error {
+	metrics := Metrics(r)
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.timeout)
+	defer cancel()
+
+	res, err := e.metrics.Export(ctx, &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{
+			{
+				Resource: resource,
+				ScopeMetrics: []*metricspb.ScopeMetrics{
+					{
+						Scope:   &commonpb.InstrumentationScope{Name: scope},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return permanent(err)
+	}
+
+	if p := res.GetPartialSuccess(); p.GetRejectedDataPoints() > 0 {
+		return gel.Permanent(fmt.Errorf("%d data points rejected: %s", p.RejectedDataPoints, p.ErrorMessage))
+	}
+
+	return nil
+}
+
+func (e *Exporter) exportLogs(resource *resourcepb.Resource, r *pb.Record) error {
+	logs := LogRecords(r)
+	if len(logs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.timeout)
+	defer cancel()
+
+	res, err := e.logs.Export(ctx, &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{
+			{
+				Resource: resource,
+				ScopeLogs: []*logspb.ScopeLogs{
+					{
+						Scope:      &commonpb.InstrumentationScope{Name: scope},
+						LogRecords: logs,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return permanent(err)
+	}
+
+	if p := res.GetPartialSuccess(); p.GetRejectedLogRecords() > 0 {
+		return gel.Permanent(fmt.Errorf("%d log records rejected: %s", p.RejectedLogRecords, p.ErrorMessage))
+	}
+
+	return nil
+}
+
+// permanent marks the errors of the records the receiver refuses, which
+// retrying would not help with.
+func permanent(err error) error {
+	if status.Code(err) == codes.InvalidArgument {
+		return gel.Permanent(err)
+	}
+
+	return err
+}
+
+func (e *Exporter) resource(session string) *resourcepb.Resource {
+	attributes := []*commonpb.KeyValue{
+		keyValue("service.name", e.opts.serviceName),
+		keyValue("service.instance.id", session),
+	}
+
+	for k, v := range e.opts.resource {
+		attributes = append(attributes, keyValue(k, v))
+	}
+
+	return &resourcepb.Resource{
+		Attributes: attributes,
+	}
+}
+
+// Metrics returns the numbers of r as delta sums and its instants as
+// gauges, one metric per name with a point per tagged series.
+func Metrics(r *pb.Record) []*metricspb.Metric {
+	start, end := interval(r)
+
+	sums := map[string]*metricspb.Sum{}
+	gauges := map[string]*metricspb.Gauge{}
+	metrics := []*metricspb.Metric{}
+
+	sum := func(name string) *metricspb.Sum {
+		s, ok := sums[name]
+		if !ok {
+			s = &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			}
+
+			sums[name] = s
+			metrics = append(metrics, &metricspb.Metric{
+				Name: name,
+				Data: &metricspb.Metric_Sum{Sum: s},
+			})
+		}
+
+		return s
+	}
+
+	for k, v := range r.Numbers {
+		name, tags := gel.SplitTags(k)
+
+		s := sum(name)
+		s.DataPoints = append(s.DataPoints, &metricspb.NumberDataPoint{
+			Attributes:        attributes(tags),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      end,
+			Value:             &metricspb.NumberDataPoint_AsInt{AsInt: v},
+		})
+	}
+
+	for k, v := range r.Instants {
+		name, tags := gel.SplitTags(k)
+
+		g, ok := gauges[name]
+		if !ok {
+			g = &metricspb.Gauge{}
+
+			gauges[name] = g
+			metrics = append(metrics, &metricspb.Metric{
+				Name: name,
+				Data: &metricspb.Metric_Gauge{Gauge: g},
+			})
+		}
+
+		g.DataPoints = append(g.DataPoints, &metricspb.NumberDataPoint{
+			Attributes:   attributes(tags),
+			TimeUnixNano: end,
+			Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: v},
+		})
+	}
+
+	for template, logs := range r.Logs {
+		if logs.Suppressed == 0 {
+			continue
+		}
+
+		s := sum(SuppressedName)
+		s.DataPoints = append(s.DataPoints, &metricspb.NumberDataPoint{
+			Attributes:        []*commonpb.KeyValue{keyValue("template", template)},
+			StartTimeUnixNano: start,
+			TimeUnixNano:      end,
+			Value:             &metricspb.NumberDataPoint_AsInt{AsInt: logs.Suppressed},
+		})
+	}
+
+	return metrics
+}
+
+// LogRecords returns the messages of r as log records.
+func LogRecords(r *pb.Record) []*logspb.LogRecord {
+	start, _ := interval(r)
+	records := []*logspb.LogRecord{}
+
+	for template, logs := range r.Logs {
+		for _, m := range logs.Logs {
+			parameters := make([]*commonpb.AnyValue, len(m.Parameters))
+			for i, p := range m.Parameters {
+				parameters[i] = stringValue(p)
+			}
+
+			t := start + uint64(m.Offset)
+
+			records = append(records, &logspb.LogRecord{
+				TimeUnixNano:         t,
+				ObservedTimeUnixNano: t,
+				SeverityNumber:       severity(m.Level),
+				SeverityText:         m.Level.String(),
+				Body:                 stringValue(gel.FormatLog(template, m.Parameters)),
+				Attributes: []*commonpb.KeyValue{
+					keyValue(TemplateAttribute, template),
+					{
+						Key: ParametersAttribute,
+						Value: &commonpb.AnyValue{
+							Value: &commonpb.AnyValue_ArrayValue{
+								ArrayValue: &commonpb.ArrayValue{Values: parameters},
+							},
+						},
+					},
+				},
+			})
+		}
+	}
+
+	return records
+}
+
+// interval returns the start and the end of r in nanoseconds since the
+// epoch, older records only having Ts.
+func interval(r *pb.Record) (uint64, uint64) {
+	start := r.Start
+	if start == nil {
+		start = r.Ts
+	}
+
+	s, err := ptypes.Timestamp(start)
+	if err != nil {
+		s = time.Now()
+	}
+
+	e, err := ptypes.Timestamp(r.End)
+	if err != nil || e.Before(s) {
+		e = s
+	}
+
+	return uint64(s.UnixNano()), uint64(e.UnixNano())
+}
+
+func severity(l pb.Level) logspb.SeverityNumber {
+	switch l {
+	case pb.Level_DEBUG:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG
+	case pb.Level_WARN:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case pb.Level_ERROR:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case pb.Level_FATAL:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL
+	}
+
+	return logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+}
+
+func attributes(tags []string) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(tags)/2)
+	for i := 0; i+1 < len(tags); i += 2 {
+		kvs = append(kvs, keyValue(tags[i], tags[i+1]))
+	}
+
+	return kvs
+}
+
+func keyValue(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   k,
+		Value: stringValue(v),
+	}
+}
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{
+		Value: &commonpb.AnyValue_StringValue{StringValue: s},
+	}
+}
@@ -0,0 +1,180 @@
+package otlpgel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/duanckham/gel/gel"
+	"github.com/duanckham/gel/pb"
+)
+
+// receiver is an OTLP receiver keeping the requests it accepts, failing
+// the first failLogs logs requests as unavailable.
+type receiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	collogspb.UnimplementedLogsServiceServer
+
+	mu       sync.Mutex
+	metrics  []*colmetricspb.ExportMetricsServiceRequest
+	logs     []*collogspb.ExportLogsServiceRequest
+	failLogs int
+	rejected int64
+}
+
+func (rc *receiver) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	defer rc.mu.Unlock()
+	rc.mu.Lock()
+
+	rc.metrics = append(rc.metrics, req)
+
+	res := &colmetricspb.ExportMetricsServiceResponse{}
+	if rc.rejected > 0 {
+		res.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rc.rejected,
+			ErrorMessage:       "rejected",
+		}
+	}
+
+	return res, nil
+}
+
+// logsService adapts the receiver to the logs service, whose method has the
+// same name as the metrics one.
+type logsService struct {
+	*receiver
+}
+
+func (s logsService) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	if s.failLogs > 0 {
+		s.failLogs--
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+
+	s.logs = append(s.logs, req)
+
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// serve starts rc on a local port and returns an Exporter sending to it.
+func serve(t *testing.T, rc *receiver) *Exporter {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(s, rc)
+	collogspb.RegisterLogsServiceServer(s, logsService{rc})
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return New(conn, WithServiceName("api"), WithTimeout(5*time.Second))
+}
+
+func record(seq uint64) *pb.Record {
+	start, _ := ptypes.TimestampProto(time.Now().Add(-time.Minute))
+	end, _ := ptypes.TimestampProto(time.Now())
+
+	return &pb.Record{
+		Session:  "api-1",
+		Seq:      seq,
+		Start:    start,
+		End:      end,
+		Numbers:  map[string]int64{"requests{route=/users}": 3},
+		Instants: map[string]float64{"queue.size": 7},
+		Logs: map[string]*pb.Logs{
+			"user ?? logged in": {
+				Logs: []*pb.Message{{Level: pb.Level_INFO, Parameters: []string{"ada"}}},
+			},
+		},
+	}
+}
+
+func TestExport(t *testing.T) {
+	rc := &receiver{}
+	e := serve(t, rc)
+
+	if err := e.Export(record(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.metrics) != 1 || len(rc.logs) != 1 {
+		t.Fatalf("%d metrics and %d logs requests, want 1 of each", len(rc.metrics), len(rc.logs))
+	}
+
+	metrics := map[string]bool{}
+	for _, m := range rc.metrics[0].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[m.Name] = true
+	}
+
+	if !metrics["requests"] || !metrics["queue.size"] {
+		t.Errorf("metrics %v, want requests and queue.size", metrics)
+	}
+
+	logs := rc.logs[0].ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(logs) != 1 || logs[0].Body.GetStringValue() != "user ada logged in" {
+		t.Errorf("log records %v", logs)
+	}
+}
+
+func TestExportRetriesLogsOnly(t *testing.T) {
+	rc := &receiver{failLogs: 1}
+	e := serve(t, rc)
+
+	r := record(1)
+
+	if err := e.Export(r); status.Code(err) != codes.Unavailable {
+		t.Fatalf("error %v, want unavailable", err)
+	}
+
+	if err := e.Export(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.metrics) != 1 || len(rc.logs) != 1 {
+		t.Errorf("%d metrics and %d logs requests, want the metrics sent once", len(rc.metrics), len(rc.logs))
+	}
+
+	if err := e.Export(record(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.metrics) != 2 {
+		t.Errorf("%d metrics requests, want the next record sent", len(rc.metrics))
+	}
+}
+
+func TestExportPartialRejection(t *testing.T) {
+	rc := &receiver{rejected: 1}
+	e := serve(t, rc)
+
+	err := e.Export(record(1))
+	if !gel.IsPermanent(err) {
+		t.Fatalf("error %v, want a permanent one", err)
+	}
+
+	if len(rc.logs) != 1 {
+		t.Errorf("%d logs requests, want the logs sent past the rejected metrics", len(rc.logs))
+	}
+}
@@ -0,0 +1,376 @@
+package gel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// QueuePolicy decides what happens to a record reaped while the send queue
+// is full.
+type QueuePolicy int
+
+// Queue policies.
+const (
+	// DropOldest discards the oldest queued record to make room.
+	DropOldest QueuePolicy = iota
+	// DropNewest discards the record reaped.
+	DropNewest
+	// Block queues the record anyway and makes Increment, Gauge and Log wait
+	// until the queue has room again. Rounds keep rotating on time, they are
+	// just left empty by the blocked writers.
+	Block
+	// SpillToDisk writes the record to the spill directory, records are read
+	// back once the queue drained, including after a restart. A spilled
+	// record is only removed once exported, or dropped by the exporter. It
+	// needs WithSpillDir, the queue falls back to DropOldest without.
+	SpillToDisk
+)
+
+// DefaultQueueCapacity is the number of records the send queue holds.
+const DefaultQueueCapacity = 16
+
+// Names of the series reporting the state of the send queues, tagged with
+// the exporter name.
+const (
+	QueueLengthName  = "gel.queue.length"
+	QueueDroppedName = "gel.queue.dropped"
+	QueueSpilledName = "gel.queue.spilled"
+)
+
+const spillExt = ".rec"
+
+// Bounds of the pause before a record that failed to export is retried.
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = time.Minute
+)
+
+type queueOptions struct {
+	capacity int
+	policy   QueuePolicy
+	spillDir string
+}
+
+// WithQueue sets the capacity (at least 1) and the policy of the send queue
+// of every exporter, which decouples them from the rotation of rounds.
+func WithQueue(capacity int, policy QueuePolicy) Option {
+	return func(g *gi) {
+		if capacity < 1 {
+			capacity = 1
+		}
+
+		g.queueOpts.capacity = capacity
+		g.queueOpts.policy = policy
+	}
+}
+
+// WithSpillDir sets the directory used by the SpillToDisk policy, each
+// exporter spills to the sub directory of its name.
+func WithSpillDir(dir string) Option {
+	return func(g *gi) {
+		g.queueOpts.spillDir = dir
+	}
+}
+
+// queue holds reaped records until the sender hands them to an exporter.
+type queue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	records  []*pb.Record
+	capacity int
+	policy   QueuePolicy
+	spillDir string
+	spillSeq uint64
+	spilled  []string
+	full     int32
+	closed   bool
+	done     chan struct{}
+	dropped  int64
+	spills   int64
+}
+
+// item is a record popped from the queue, with the file it was spilled to
+// if any. The file is only removed once the record is exported.
+type item struct {
+	r    *pb.Record
+	path string
+}
+
+func newQueue(o queueOptions) *queue {
+	q := &queue{
+		capacity: o.capacity,
+		policy:   o.policy,
+		spillDir: o.spillDir,
+		done:     make(chan struct{}),
+	}
+
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// recover picks up the records spilled by a previous process.
+func (q *queue) recover() error {
+	if q.policy != SpillToDisk {
+		return nil
+	}
+
+	if q.spillDir == "" {
+		return fmt.Errorf("gel: SpillToDisk needs a spill directory")
+	}
+
+	if err := os.MkdirAll(q.spillDir, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(q.spillDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), spillExt) {
+			q.spilled = append(q.spilled, filepath.Join(q.spillDir, f.Name()))
+		}
+	}
+
+	sort.Strings(q.spilled)
+
+	if n := len(q.spilled); n > 0 {
+		fmt.Sscanf(filepath.Base(q.spilled[n-1]), "%d", &q.spillSeq)
+	}
+
+	return nil
+}
+
+// push queues r according to the policy, it never blocks.
+func (q *queue) push(r *pb.Record) {
+	defer q.mu.Unlock()
+	q.mu.Lock()
+
+	if len(q.records) >= q.capacity || (q.policy == SpillToDisk && len(q.spilled) > 0) {
+		switch q.policy {
+		case DropOldest:
+			q.records = q.records[1:]
+			q.dropped++
+
+		case DropNewest:
+			q.dropped++
+			return
+
+		case Block:
+			atomic.StoreInt32(&q.full, 1)
+
+		case SpillToDisk:
+			if err := q.spill(r); err != nil {
+				fmt.Println("* gel spill err:", err)
+				q.dropped++
+			}
+
+			q.cond.Broadcast()
+			return
+		}
+	}
+
+	q.records = append(q.records, r)
+	q.cond.Broadcast()
+}
+
+func (q *queue) spill(r *pb.Record) error {
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	q.spillSeq++
+	path := filepath.Join(q.spillDir, fmt.Sprintf("%020d%s", q.spillSeq, spillExt))
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+
+	q.spilled = append(q.spilled, path)
+	q.spills++
+
+	return nil
+}
+
+// pop waits for the next record, in memory ones first as spilled ones are
+// always newer. It returns nil once the queue is closed. The record must be
+// handed back to ack, drop or requeue.
+func (q *queue) pop() *item {
+	return q.popUntil(time.Time{})
+}
+
+// popUntil is pop, returning nil past deadline too unless it is zero.
+func (q *queue) popUntil(deadline time.Time) *item {
+	if !deadline.IsZero() {
+		// Wakes the wait below at the deadline.
+		t := time.AfterFunc(time.Until(deadline), func() {
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		})
+
+		defer t.Stop()
+	}
+
+	for {
+		q.mu.Lock()
+
+		for len(q.records) == 0 && len(q.spilled) == 0 && !q.closed {
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				q.mu.Unlock()
+				return nil
+			}
+
+			q.cond.Wait()
+		}
+
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+
+		if len(q.records) > 0 {
+			r := q.records[0]
+			q.records = q.records[1:]
+
+			if len(q.records) < q.capacity && atomic.LoadInt32(&q.full) == 1 {
+				atomic.StoreInt32(&q.full, 0)
+				q.cond.Broadcast()
+			}
+
+			q.mu.Unlock()
+
+			return &item{r: r}
+		}
+
+		path := q.spilled[0]
+		q.spilled = q.spilled[1:]
+
+		q.mu.Unlock()
+
+		r, err := readSpilled(path)
+		if err != nil {
+			fmt.Println("* gel spill err:", err)
+			os.Remove(path)
+			continue
+		}
+
+		return &item{r: r, path: path}
+	}
+}
+
+// ack forgets it, exported.
+func (q *queue) ack(it *item) {
+	if it.path != "" {
+		os.Remove(it.path)
+	}
+}
+
+// drop forgets it, not exported, and counts it as dropped.
+func (q *queue) drop(it *item) {
+	q.ack(it)
+
+	defer q.mu.Unlock()
+	q.mu.Lock()
+
+	q.dropped++
+}
+
+// requeue puts it back at the head of the queue, for the next pop.
+func (q *queue) requeue(it *item) {
+	defer q.mu.Unlock()
+	q.mu.Lock()
+
+	if it.path != "" {
+		q.spilled = append([]string{it.path}, q.spilled...)
+	} else {
+		q.records = append([]*pb.Record{it.r}, q.records...)
+	}
+
+	q.cond.Broadcast()
+}
+
+// pause waits for d, it returns false if the queue is closed meanwhile.
+func (q *queue) pause(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+func readSpilled(path string) (*pb.Record, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &pb.Record{}
+	if err := proto.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (q *queue) isFull() bool {
+	return atomic.LoadInt32(&q.full) == 1
+}
+
+// wait blocks writers while a Block queue is full.
+func (q *queue) wait() {
+	if !q.isFull() {
+		return
+	}
+
+	defer q.mu.Unlock()
+	q.mu.Lock()
+
+	for q.isFull() && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+// close releases the sender and the writers waiting on the queue.
+func (q *queue) close() {
+	defer q.mu.Unlock()
+	q.mu.Lock()
+
+	if !q.closed {
+		close(q.done)
+	}
+
+	q.closed = true
+	atomic.StoreInt32(&q.full, 0)
+	q.cond.Broadcast()
+}
+
+// stats returns the queue length and resets the drop and spill counts.
+func (q *queue) stats() (length int, dropped int64, spilled int64) {
+	defer q.mu.Unlock()
+	q.mu.Lock()
+
+	length = len(q.records) + len(q.spilled)
+	dropped, spilled = q.dropped, q.spills
+	q.dropped, q.spills = 0, 0
+
+	return length, dropped, spilled
+}
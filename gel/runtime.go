@@ -0,0 +1,161 @@
+package gel
+
+import (
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strings"
+	"time"
+)
+
+// Metric name prefixes used by the runtime collector.
+const (
+	RuntimeMetricPrefix = "go."
+	ProcessMetricPrefix = "process."
+)
+
+// runtimeCollector samples Go runtime and process statistics into a Gel.
+//
+// Values that only ever grow (GC cycles, allocated bytes, CPU time) are
+// reported as the delta since the previous sample through Increment, so the
+// numbers of a record cover exactly one round. The first sample only records
+// their baseline, the totals since the process started are not reported.
+// Everything else is a gauge.
+type runtimeCollector struct {
+	g          Gel
+	samples    []metrics.Sample
+	cumulative map[string]bool
+	last       map[string]metrics.Value
+	numGC      int64
+	gcSeen     bool
+	proc       processStats
+}
+
+// CollectRuntime starts sampling runtime metrics, goroutines, GC and process
+// statistics into g every period. It returns a function stopping the
+// collector.
+//
+// Names are stable and derived as follows:
+//
+//	runtime/metrics "/gc/heap/allocs:bytes" -> "go.gc.heap.allocs.bytes"
+//	goroutines                             -> "go.goroutines"
+//	GC pauses                              -> "go.gc.pause.*"
+//	/proc/self                             -> "process.*" (Linux only)
+func CollectRuntime(g Gel, period time.Duration) func() {
+	c := &runtimeCollector{
+		g:          g,
+		cumulative: map[string]bool{},
+		last:       map[string]metrics.Value{},
+	}
+
+	for _, d := range metrics.All() {
+		switch d.Kind {
+		case metrics.KindUint64, metrics.KindFloat64:
+			c.samples = append(c.samples, metrics.Sample{Name: d.Name})
+			c.cumulative[d.Name] = d.Cumulative
+		}
+	}
+
+	stop := make(chan struct{})
+
+	go func() {
+		t := time.NewTicker(period)
+		defer t.Stop()
+
+		c.collect()
+
+		for {
+			select {
+			case <-t.C:
+				c.collect()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+	}
+}
+
+func (c *runtimeCollector) collect() {
+	c.collectMetrics()
+	c.collectGC()
+	c.proc.collect(c.g)
+
+	c.g.Gauge(RuntimeMetricPrefix+"goroutines", float64(runtime.NumGoroutine()))
+}
+
+func (c *runtimeCollector) collectMetrics() {
+	metrics.Read(c.samples)
+
+	for _, s := range c.samples {
+		name := RuntimeMetricName(s.Name)
+		last, seen := c.last[s.Name]
+
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			v := s.Value.Uint64()
+
+			if !c.cumulative[s.Name] {
+				c.g.Gauge(name, float64(v))
+			} else if seen {
+				c.g.Increment(name, int64(v-last.Uint64()))
+			}
+
+		case metrics.KindFloat64:
+			v := s.Value.Float64()
+
+			// Cumulative floats are CPU seconds, the delta stays a gauge to
+			// keep the fraction.
+			if !c.cumulative[s.Name] {
+				c.g.Gauge(name, v)
+			} else if seen {
+				c.g.Gauge(name, v-last.Float64())
+			}
+		}
+
+		c.last[s.Name] = s.Value
+	}
+}
+
+func (c *runtimeCollector) collectGC() {
+	stats := debug.GCStats{}
+	debug.ReadGCStats(&stats)
+
+	if c.gcSeen {
+		n := stats.NumGC - c.numGC
+		if n > int64(len(stats.Pause)) {
+			n = int64(len(stats.Pause))
+		}
+
+		// Pauses are ordered most recent first.
+		var max time.Duration
+		for _, p := range stats.Pause[:n] {
+			if p > max {
+				max = p
+			}
+		}
+
+		c.g.Increment(RuntimeMetricPrefix+"gc.count", stats.NumGC-c.numGC)
+		c.g.Gauge(RuntimeMetricPrefix+"gc.pause.max_ns", float64(max))
+	}
+
+	c.g.Gauge(RuntimeMetricPrefix+"gc.pause.total_ns", float64(stats.PauseTotal))
+
+	if len(stats.Pause) > 0 {
+		c.g.Gauge(RuntimeMetricPrefix+"gc.pause.last_ns", float64(stats.Pause[0]))
+	}
+
+	c.numGC = stats.NumGC
+	c.gcSeen = true
+}
+
+// RuntimeMetricName maps a runtime/metrics name onto the gel naming scheme.
+func RuntimeMetricName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	name = strings.NewReplacer("/", ".", ":", ".", "*", "").Replace(name)
+
+	return RuntimeMetricPrefix + name
+}
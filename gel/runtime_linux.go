@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package gel
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is USER_HZ, which is 100 on every Linux platform Go supports.
+const clockTicks = 100
+
+// processStats reads process statistics from /proc/self. The CPU times are
+// reported from the second sample on, as deltas.
+type processStats struct {
+	utime int64
+	stime int64
+	seen  bool
+}
+
+func (p *processStats) collect(g Gel) {
+	if b, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(b))
+
+		if len(fields) > 1 {
+			page := int64(os.Getpagesize())
+			vsz, _ := strconv.ParseInt(fields[0], 10, 64)
+			rss, _ := strconv.ParseInt(fields[1], 10, 64)
+
+			g.Gauge(ProcessMetricPrefix+"memory.virtual_bytes", float64(vsz*page))
+			g.Gauge(ProcessMetricPrefix+"memory.rss_bytes", float64(rss*page))
+		}
+	}
+
+	if entries, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		g.Gauge(ProcessMetricPrefix+"fds", float64(len(entries)))
+	}
+
+	if b, err := ioutil.ReadFile("/proc/self/stat"); err == nil {
+		// The command name may contain spaces, skip past its closing paren.
+		s := string(b)
+		if i := strings.LastIndexByte(s, ')'); i >= 0 {
+			s = s[i+1:]
+		}
+
+		// Fields here start at "state", which is field 3 in proc(5).
+		fields := strings.Fields(s)
+
+		if len(fields) > 17 {
+			utime, _ := strconv.ParseInt(fields[11], 10, 64)
+			stime, _ := strconv.ParseInt(fields[12], 10, 64)
+			threads, _ := strconv.ParseInt(fields[17], 10, 64)
+
+			if p.seen {
+				g.Increment(ProcessMetricPrefix+"cpu.user_ms", (utime-p.utime)*1000/clockTicks)
+				g.Increment(ProcessMetricPrefix+"cpu.system_ms", (stime-p.stime)*1000/clockTicks)
+			}
+
+			g.Gauge(ProcessMetricPrefix+"threads", float64(threads))
+
+			p.utime = utime
+			p.stime = stime
+			p.seen = true
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package gel
+
+// processStats is a no-op outside Linux, where /proc/self is not available.
+type processStats struct{}
+
+func (p *processStats) collect(g Gel) {}
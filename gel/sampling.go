@@ -0,0 +1,148 @@
+package gel
+
+import (
+	"time"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// Level is the severity of a log message.
+type Level = pb.Level
+
+// Log levels, Log uses LevelInfo.
+const (
+	LevelDebug = pb.Level_DEBUG
+	LevelInfo  = pb.Level_INFO
+	LevelWarn  = pb.Level_WARN
+	LevelError = pb.Level_ERROR
+	LevelFatal = pb.Level_FATAL
+)
+
+// Sampling decides which messages of a template are kept. Messages at
+// LevelError and above are always kept, the others are counted in the
+// Suppressed field of their template when left out.
+//
+// The first First messages of a round are kept, past them one in Every is
+// kept, or none when Every is 0. Leaving both to 0 keeps every message. Rate,
+// when not 0, further limits the template to Rate messages per second with
+// bursts of Burst (at least 1), across rounds.
+type Sampling struct {
+	First int
+	Every int
+	Rate  float64
+	Burst int
+}
+
+// WithSampling sets the sampling policy of every template.
+func WithSampling(s Sampling) Option {
+	return func(g *gi) {
+		g.sampling = &s
+	}
+}
+
+// WithTemplateSampling sets the sampling policy of template, it takes
+// precedence over WithSampling.
+func WithTemplateSampling(template string, s Sampling) Option {
+	return func(g *gi) {
+		if g.templateSampling == nil {
+			g.templateSampling = map[string]*Sampling{}
+		}
+
+		g.templateSampling[template] = &s
+	}
+}
+
+// tokenBucket is the rate limiter of a template.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func burst(s *Sampling) float64 {
+	if s.Burst < 1 {
+		return 1
+	}
+
+	return float64(s.Burst)
+}
+
+func (b *tokenBucket) refill(s *Sampling, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * s.Rate
+	b.last = now
+
+	if b.tokens > burst(s) {
+		b.tokens = burst(s)
+	}
+}
+
+func (b *tokenBucket) take(s *Sampling, now time.Time) bool {
+	b.refill(s, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (g *gi) policy(template string) *Sampling {
+	if s, ok := g.templateSampling[template]; ok {
+		return s
+	}
+
+	return g.sampling
+}
+
+// sample reports whether the message of template should be kept, seen is the
+// number of messages of the template met so far this round. It must be
+// called with logsMu held.
+func (g *gi) sample(template string, level Level, seen int64, now time.Time) bool {
+	s := g.policy(template)
+	if s == nil || level >= LevelError {
+		return true
+	}
+
+	if s.First > 0 || s.Every > 0 {
+		n := seen - int64(s.First)
+
+		if n >= 0 && (s.Every == 0 || n%int64(s.Every) != 0) {
+			return false
+		}
+	}
+
+	if s.Rate > 0 {
+		b, ok := g.buckets[template]
+		if !ok {
+			b = &tokenBucket{
+				tokens: burst(s),
+				last:   now,
+			}
+
+			g.buckets[template] = b
+		}
+
+		return b.take(s, now)
+	}
+
+	return true
+}
+
+// pruneBuckets forgets the buckets that refilled completely, they behave as
+// new ones. It keeps templates seen once from piling up.
+func (g *gi) pruneBuckets(now time.Time) {
+	defer g.logsMu.Unlock()
+	g.logsMu.Lock()
+
+	for template, b := range g.buckets {
+		s := g.policy(template)
+		if s != nil {
+			b.refill(s, now)
+		}
+
+		if s == nil || b.tokens >= burst(s) {
+			delete(g.buckets, template)
+		}
+	}
+}
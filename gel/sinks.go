@@ -0,0 +1,103 @@
+package gel
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/golang/protobuf/jsonpb"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// FileExporter appends records to a file as JSON lines.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	m    jsonpb.Marshaler
+}
+
+// NewFileExporter opens path for appending, creating it if needed.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileExporter{
+		file: f,
+	}, nil
+}
+
+// Export implements Exporter.
+func (e *FileExporter) Export(r *pb.Record) error {
+	b := bytes.Buffer{}
+	if err := e.m.Marshal(&b, r); err != nil {
+		return err
+	}
+
+	b.WriteByte('\n')
+
+	defer e.mu.Unlock()
+	e.mu.Lock()
+
+	_, err := e.file.Write(b.Bytes())
+
+	return err
+}
+
+// Close closes the file.
+func (e *FileExporter) Close() error {
+	return e.file.Close()
+}
+
+// DebugExporter keeps the last records in memory and serves them as JSON
+// over HTTP, most recent first.
+type DebugExporter struct {
+	mu      sync.Mutex
+	records []*pb.Record
+	size    int
+}
+
+// NewDebugExporter returns a DebugExporter keeping size records.
+func NewDebugExporter(size int) *DebugExporter {
+	return &DebugExporter{
+		size: size,
+	}
+}
+
+// Export implements Exporter.
+func (e *DebugExporter) Export(r *pb.Record) error {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+
+	e.records = append([]*pb.Record{r}, e.records...)
+	if len(e.records) > e.size {
+		e.records = e.records[:e.size]
+	}
+
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (e *DebugExporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	e.mu.Lock()
+	records := e.records
+	e.mu.Unlock()
+
+	m := jsonpb.Marshaler{}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("["))
+
+	for i, r := range records {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+
+		m.Marshal(w, r)
+	}
+
+	w.Write([]byte("]\n"))
+}
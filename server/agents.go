@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/peer"
+
+	"github.com/duanckham/gel/pb"
+)
+
+type agent struct {
+	session   string
+	address   string
+	firstSeen time.Time
+	lastSeen  time.Time
+	records   uint64
+	lastSeq   uint64
+	relay     string
+}
+
+// agents tracks the agent sessions sending records, the ones silent for
+// longer than sessionTTL are forgotten.
+type agents struct {
+	mu        sync.Mutex
+	sessions  map[string]*agent
+	lastPrune time.Time
+}
+
+func newAgents() *agents {
+	return &agents{
+		sessions:  map[string]*agent{},
+		lastPrune: time.Now(),
+	}
+}
+
+// seen records a delivery of r by the peer of ctx.
+func (as *agents) seen(ctx context.Context, r *pb.Record) {
+	defer as.mu.Unlock()
+	as.mu.Lock()
+
+	now := time.Now()
+
+	if now.Sub(as.lastPrune) >= time.Minute {
+		as.lastPrune = now
+
+		for session, a := range as.sessions {
+			if now.Sub(a.lastSeen) > sessionTTL {
+				delete(as.sessions, session)
+			}
+		}
+	}
+
+	a, ok := as.sessions[r.Session]
+	if !ok {
+		a = &agent{
+			session:   r.Session,
+			firstSeen: now,
+		}
+
+		as.sessions[r.Session] = a
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		a.address = p.Addr.String()
+		a.relay = ""
+
+		// Forwarded by a relay.
+		if r.Address != "" {
+			a.address = r.Address
+			a.relay = p.Addr.String()
+		}
+	}
+
+	a.lastSeen = now
+	a.records++
+
+	if r.Seq > a.lastSeq {
+		a.lastSeq = r.Seq
+	}
+}
+
+// list returns the agents, the last seen first.
+func (as *agents) list() []*pb.Agent {
+	defer as.mu.Unlock()
+	as.mu.Lock()
+
+	sorted := make([]*agent, 0, len(as.sessions))
+	for _, a := range as.sessions {
+		sorted = append(sorted, a)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].lastSeen.After(sorted[j].lastSeen)
+	})
+
+	list := make([]*pb.Agent, 0, len(sorted))
+
+	for _, a := range sorted {
+		lastSeen, _ := ptypes.TimestampProto(a.lastSeen)
+
+		list = append(list, &pb.Agent{
+			Session:  a.session,
+			Address:  a.address,
+			LastSeen: lastSeen,
+			Records:  a.records,
+			LastSeq:  a.lastSeq,
+			Relay:    a.relay,
+		})
+	}
+
+	return list
+}
+
+// restarts returns every session known, true for the ones another session
+// of the same host took over, its first record coming after their last one.
+// Sessions of a host sending at the same time, sidecars or agents sharing a
+// machine, are different agents and never taken for restarts.
+func (as *agents) restarts() map[string]bool {
+	defer as.mu.Unlock()
+	as.mu.Lock()
+
+	restarted := make(map[string]bool, len(as.sessions))
+
+	for session, a := range as.sessions {
+		restarted[session] = false
+
+		host := a.host()
+		if host == "" {
+			continue
+		}
+
+		for other, b := range as.sessions {
+			if other != session && b.host() == host && b.firstSeen.After(a.lastSeen) {
+				restarted[session] = true
+				break
+			}
+		}
+	}
+
+	return restarted
+}
+
+// host returns the host of the address of a, empty when unknown.
+func (a *agent) host() string {
+	host, _, err := net.SplitHostPort(a.address)
+	if err != nil {
+		return a.address
+	}
+
+	return host
+}
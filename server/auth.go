@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const bearerPrefix = "Bearer "
+
+// authorize checks the token of a gRPC call, see WithTokens.
+func (gs *GelServer) authorize(ctx context.Context) error {
+	if len(gs.tokens) == 0 {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, v := range md.Get("authorization") {
+		if gs.allowed(v) {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "missing or unknown token")
+}
+
+// allowed tells whether the authorization value carries a known bearer
+// token.
+func (gs *GelServer) allowed(authorization string) bool {
+	if len(gs.tokens) == 0 {
+		return true
+	}
+
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return false
+	}
+
+	token := []byte(strings.TrimPrefix(authorization, bearerPrefix))
+	ok := false
+
+	for t := range gs.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			ok = true
+		}
+	}
+
+	return ok
+}
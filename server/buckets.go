@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// DefaultBucketWidth is the width of the time buckets records are summed
+// into, it matches the period of agents aligned on the wall clock.
+const DefaultBucketWidth = 5 * time.Second
+
+// DefaultPercentiles are the percentiles of the instants across agents.
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// bucket holds the values of every agent for the records ending in the same
+// interval, numbers summed per agent and the last instant of each.
+type bucket struct {
+	Start    time.Time
+	End      time.Time
+	Agents   map[string]bool
+	Numbers  map[string]map[string]int64
+	Instants map[string]map[string]float64
+}
+
+// buckets assigns records to the bucket holding their end, a record of an
+// agent aligned with the bucket width falls exactly in one bucket. Buckets
+// close grace after their end, records of a closed bucket are left out.
+type buckets struct {
+	mu      sync.Mutex
+	width   time.Duration
+	grace   time.Duration
+	buckets map[int64]*bucket
+	closed  func(b *bucket)
+	// until is the end of the last bucket closed.
+	until time.Time
+	late  int64
+}
+
+func newBuckets(width, grace time.Duration, closed func(b *bucket)) *buckets {
+	bs := &buckets{
+		width:   width,
+		grace:   grace,
+		buckets: map[int64]*bucket{},
+		closed:  closed,
+	}
+
+	go bs.run()
+
+	return bs
+}
+
+func (bs *buckets) add(r *pb.Record) {
+	if r.End == nil {
+		return
+	}
+
+	end, err := ptypes.Timestamp(r.End)
+	if err != nil {
+		return
+	}
+
+	start := end.Add(-1).Truncate(bs.width)
+
+	defer bs.mu.Unlock()
+	bs.mu.Lock()
+
+	if start.Before(bs.until) {
+		bs.late++
+		return
+	}
+
+	b, ok := bs.buckets[start.UnixNano()]
+	if !ok {
+		b = &bucket{
+			Start:    start,
+			End:      start.Add(bs.width),
+			Agents:   map[string]bool{},
+			Numbers:  map[string]map[string]int64{},
+			Instants: map[string]map[string]float64{},
+		}
+
+		bs.buckets[start.UnixNano()] = b
+	}
+
+	b.Agents[r.Session] = true
+
+	for k, v := range r.Numbers {
+		if b.Numbers[k] == nil {
+			b.Numbers[k] = map[string]int64{}
+		}
+
+		b.Numbers[k][r.Session] += v
+	}
+
+	for k, v := range r.Instants {
+		if b.Instants[k] == nil {
+			b.Instants[k] = map[string]float64{}
+		}
+
+		b.Instants[k][r.Session] = v
+	}
+}
+
+// run closes the buckets once late records are no longer expected.
+func (bs *buckets) run() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for now := range t.C {
+		closed := []*bucket{}
+
+		bs.mu.Lock()
+		for k, b := range bs.buckets {
+			if now.After(b.End.Add(bs.grace)) {
+				closed = append(closed, b)
+				delete(bs.buckets, k)
+
+				if b.End.After(bs.until) {
+					bs.until = b.End
+				}
+			}
+		}
+
+		late := bs.late
+		bs.late = 0
+		bs.mu.Unlock()
+
+		if late > 0 {
+			fmt.Println("* (bucket) late records left out:", late)
+		}
+
+		sort.Slice(closed, func(i, j int) bool {
+			return closed[i].Start.Before(closed[j].Start)
+		})
+
+		for _, b := range closed {
+			bs.closed(b)
+		}
+	}
+}
+
+func printBucket(b *bucket) {
+	fmt.Println("* (bucket)", b.Start, "agents:", len(b.Agents), "numbers:", len(b.Numbers), "instants:", len(b.Instants))
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// DashboardPath is the path of the web dashboard, see WithDashboard.
+const DashboardPath = "/ui/"
+
+// defaultQueryRange is how far back a query of the dashboard goes when
+// from is not given.
+const defaultQueryRange = time.Hour
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+// registerDashboard adds the dashboard and the API it is built on to mux.
+// The API calls the gRPC endpoints, with the token of the request.
+func (gs *GelServer) registerDashboard(mux *http.ServeMux) {
+	assets, _ := fs.Sub(dashboardAssets, "dashboard")
+
+	mux.Handle(DashboardPath, http.StripPrefix(DashboardPath, http.FileServer(http.FS(assets))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.Redirect(w, r, DashboardPath, http.StatusFound)
+	})
+
+	mux.HandleFunc("/api/agents", gs.serveAgents)
+	mux.HandleFunc("/api/query", gs.serveQuery)
+	mux.HandleFunc("/api/templates", gs.serveTemplates)
+	mux.HandleFunc("/api/parameters", gs.serveParameters)
+	mux.HandleFunc("/api/messages", gs.serveMessages)
+	mux.HandleFunc("/api/tail", gs.serveTail)
+}
+
+// serveAgents answers Agents in JSON.
+func (gs *GelServer) serveAgents(w http.ResponseWriter, r *http.Request) {
+	res, err := gs.Agents(apiContext(r), &pb.AgentsRequest{})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	writeProto(w, res)
+}
+
+// serveQuery answers Query in JSON. The name, agent, from and to parameters
+// are those of pb.QueryRequest, from and to in RFC 3339 or as a duration
+// before now such as "15m".
+func (gs *GelServer) serveQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now()
+
+	from, err := parseTime(q.Get("from"), now)
+	if err != nil {
+		httpError(w, status.Errorf(codes.InvalidArgument, "from: %v", err))
+		return
+	}
+
+	if from.IsZero() {
+		from = now.Add(-defaultQueryRange)
+	}
+
+	to, err := parseTime(q.Get("to"), now)
+	if err != nil {
+		httpError(w, status.Errorf(codes.InvalidArgument, "to: %v", err))
+		return
+	}
+
+	in := &pb.QueryRequest{
+		Name:  q.Get("name"),
+		Agent: q.Get("agent"),
+	}
+
+	in.From, _ = ptypes.TimestampProto(from)
+	if !to.IsZero() {
+		in.To, _ = ptypes.TimestampProto(to)
+	}
+
+	res, err := gs.Query(apiContext(r), in)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	writeProto(w, res)
+}
+
+// serveTemplates answers Templates in JSON. The agent and limit parameters
+// are those of pb.TemplatesRequest, window is a duration such as "1h".
+func (gs *GelServer) serveTemplates(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	in := &pb.TemplatesRequest{
+		Agent: q.Get("agent"),
+	}
+
+	if window := q.Get("window"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			httpError(w, status.Errorf(codes.InvalidArgument, "window: %v", err))
+			return
+		}
+
+		in.Window = ptypes.DurationProto(d)
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			httpError(w, status.Errorf(codes.InvalidArgument, "limit: %v", err))
+			return
+		}
+
+		in.Limit = int32(n)
+	}
+
+	res, err := gs.Templates(apiContext(r), in)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	writeProto(w, res)
+}
+
+// serveParameters answers Parameters in JSON, for the template and limit
+// parameters.
+func (gs *GelServer) serveParameters(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	in := &pb.ParametersRequest{
+		Template: q.Get("template"),
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			httpError(w, status.Errorf(codes.InvalidArgument, "limit: %v", err))
+			return
+		}
+
+		in.Limit = int32(n)
+	}
+
+	res, err := gs.Parameters(apiContext(r), in)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	writeProto(w, res)
+}
+
+// serveMessages answers the last messages received of a template, for the
+// drill down into its parameters.
+func (gs *GelServer) serveMessages(w http.ResponseWriter, r *http.Request) {
+	if !gs.allowed(authorization(r)) {
+		httpError(w, status.Error(codes.Unauthenticated, "missing or unknown token"))
+		return
+	}
+
+	q := r.URL.Query()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": gs.recent.list(q.Get("template"), q.Get("agent")),
+	})
+}
+
+// serveTail streams Tail as server-sent events, a pb.Unit in JSON each. The
+// agent, template, metric and level parameters are those of
+// pb.TailRequest, type may be repeated.
+func (gs *GelServer) serveTail(w http.ResponseWriter, r *http.Request) {
+	if !gs.allowed(authorization(r)) {
+		httpError(w, status.Error(codes.Unauthenticated, "missing or unknown token"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, status.Error(codes.Internal, "streaming unsupported"))
+		return
+	}
+
+	q := r.URL.Query()
+
+	in := &pb.TailRequest{
+		Agent:    q.Get("agent"),
+		Template: q.Get("template"),
+		Metric:   q.Get("metric"),
+		Types:    q["type"],
+	}
+
+	if level := q.Get("level"); level != "" {
+		l, ok := pb.Level_value[strings.ToUpper(level)]
+		if !ok {
+			httpError(w, status.Errorf(codes.InvalidArgument, "unknown level %q", level))
+			return
+		}
+
+		in.Level = pb.Level(l)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := gs.Tail(in, &eventStream{
+		ctx:     apiContext(r),
+		w:       w,
+		flusher: flusher,
+	})
+	if err != nil {
+		fmt.Println("* gel dashboard tail err:", err)
+	}
+}
+
+// eventStream is a Tail stream writing server-sent events.
+type eventStream struct {
+	grpc.ServerStream
+
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s *eventStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *eventStream) Send(u *pb.Unit) error {
+	b, err := protojson.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", b); err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+
+	return nil
+}
+
+// apiContext carries the authorization of r as the metadata of a gRPC call.
+func apiContext(r *http.Request) context.Context {
+	return metadata.NewIncomingContext(r.Context(), metadata.Pairs("authorization", authorization(r)))
+}
+
+// parseTime reads s in RFC 3339, or as a duration before now. It returns
+// the zero time when s is empty.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeProto(w http.ResponseWriter, m proto.Message) {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		httpError(w, status.Errorf(codes.Internal, "marshal: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,535 @@
+// The dashboard of a gel server, built on its JSON API under /api/.
+(function () {
+  "use strict";
+
+  var tokenKey = "gel.token";
+  var colors = ["#1e88e5", "#e53935", "#43a047", "#fb8c00", "#8e24aa", "#00acc1", "#6d4c41", "#546e7a"];
+  var maxTailLines = 500;
+
+  function $(selector, root) {
+    return (root || document).querySelector(selector);
+  }
+
+  function $$(selector, root) {
+    return Array.prototype.slice.call((root || document).querySelectorAll(selector));
+  }
+
+  function el(tag, attributes, children) {
+    var e = document.createElement(tag);
+    Object.keys(attributes || {}).forEach(function (k) {
+      e.setAttribute(k, attributes[k]);
+    });
+    (children || []).forEach(function (c) {
+      e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+    });
+    return e;
+  }
+
+  function svg(tag, attributes) {
+    var e = document.createElementNS("http://www.w3.org/2000/svg", tag);
+    Object.keys(attributes || {}).forEach(function (k) {
+      e.setAttribute(k, attributes[k]);
+    });
+    return e;
+  }
+
+  function token() {
+    return localStorage.getItem(tokenKey) || "";
+  }
+
+  function askToken() {
+    var t = prompt("Token of the gel server", token());
+    if (t !== null) {
+      localStorage.setItem(tokenKey, t);
+    }
+    return t !== null;
+  }
+
+  // api gets path, asking for a token once when the server refuses it.
+  function api(path, retried) {
+    var headers = {};
+    if (token()) {
+      headers.Authorization = "Bearer " + token();
+    }
+
+    return fetch(path, { headers: headers }).then(function (res) {
+      if (res.status === 401 && !retried && askToken()) {
+        return api(path, true);
+      }
+      if (!res.ok) {
+        return res.text().then(function (text) {
+          throw new Error(res.status + " " + text.trim());
+        });
+      }
+      return res.json();
+    });
+  }
+
+  function query(params) {
+    var q = Object.keys(params).filter(function (k) {
+      return params[k] !== undefined && params[k] !== "";
+    }).map(function (k) {
+      return encodeURIComponent(k) + "=" + encodeURIComponent(params[k]);
+    });
+    return q.length ? "?" + q.join("&") : "";
+  }
+
+  function formatTime(t) {
+    return new Date(t).toLocaleString();
+  }
+
+  function formatValue(v) {
+    if (Math.abs(v) >= 1e6 || (v !== 0 && Math.abs(v) < 1e-2)) {
+      return v.toExponential(2);
+    }
+    return String(Math.round(v * 100) / 100);
+  }
+
+  function showError(target, err) {
+    target.textContent = err.message;
+    target.className = "info error";
+  }
+
+  // Views.
+
+  function showView() {
+    var name = location.hash.slice(1) || "agents";
+    $$(".view").forEach(function (v) {
+      v.classList.toggle("active", v.id === name);
+    });
+    $$("header nav a").forEach(function (a) {
+      a.classList.toggle("active", a.dataset.view === name);
+    });
+  }
+
+  // Agents.
+
+  var agents = [];
+
+  function loadAgents() {
+    return api("/api/agents").then(function (res) {
+      agents = res.agents || [];
+
+      var rows = $("#agents-rows");
+      rows.textContent = "";
+      agents.forEach(function (a) {
+        rows.appendChild(el("tr", {}, [
+          el("td", {}, [a.session]),
+          el("td", {}, [a.address || ""]),
+          el("td", {}, [a.relay || ""]),
+          el("td", {}, [a.lastSeen ? formatTime(a.lastSeen) : ""]),
+          el("td", { "class": "number" }, [a.records || "0"]),
+          el("td", { "class": "number" }, [a.lastSeq || "0"])
+        ]));
+      });
+
+      $("#agents-updated").textContent = "updated " + new Date().toLocaleTimeString();
+      fillAgentSelects();
+    }).catch(function (err) {
+      $("#agents-updated").textContent = err.message;
+    });
+  }
+
+  function fillAgentSelects() {
+    $$(".agent-select").forEach(function (s) {
+      var selected = s.value;
+      s.textContent = "";
+      s.appendChild(el("option", { value: "" }, ["every agent"]));
+      if (!s.closest("#tail-form")) {
+        s.appendChild(el("option", { value: "*" }, ["across agents (*)"]));
+      }
+      agents.forEach(function (a) {
+        s.appendChild(el("option", { value: a.session }, [a.session]));
+      });
+      s.value = selected;
+    });
+  }
+
+  // Metrics.
+
+  function range(form) {
+    var r = form.elements.range.value;
+    if (r !== "custom") {
+      return { from: r };
+    }
+    var from = form.elements.from.value;
+    var to = form.elements.to.value;
+    return {
+      from: from ? new Date(from).toISOString() : "1h",
+      to: to ? new Date(to).toISOString() : ""
+    };
+  }
+
+  // value is what a point of a series is charted as: the sum of numbers and
+  // of messages, the average of instants.
+  function value(series, p) {
+    var sum = p.sum || 0;
+    if (series.type === "instant") {
+      return sum / (Number(p.count) || 1);
+    }
+    return sum;
+  }
+
+  function loadMetrics() {
+    var form = $("#metrics-form");
+    var info = $("#metrics-info");
+    var r = range(form);
+
+    info.className = "info";
+    info.textContent = "loading…";
+
+    api("/api/query" + query({
+      name: form.elements.name.value,
+      agent: form.elements.agent.value,
+      from: r.from,
+      to: r.to
+    })).then(function (res) {
+      var series = (res.series || []).filter(function (s) {
+        return s.type !== "log";
+      });
+
+      var byName = {};
+      series.forEach(function (s) {
+        (byName[s.name] = byName[s.name] || []).push(s);
+      });
+
+      var charts = $("#charts");
+      charts.textContent = "";
+      Object.keys(byName).sort().forEach(function (name) {
+        charts.appendChild(chart(name, byName[name]));
+      });
+
+      info.textContent = series.length + " series, resolution " + (res.resolution && res.resolution !== "0s" ? res.resolution : "raw");
+    }).catch(function (err) {
+      showError(info, err);
+    });
+  }
+
+  function chart(name, series) {
+    var width = 400;
+    var height = 140;
+    var pad = 36;
+
+    var xs = [];
+    var ys = [];
+    series.forEach(function (s) {
+      (s.points || []).forEach(function (p) {
+        xs.push(Date.parse(p.time));
+        ys.push(value(s, p));
+      });
+    });
+
+    var minX = Math.min.apply(null, xs);
+    var maxX = Math.max.apply(null, xs);
+    var minY = Math.min(0, Math.min.apply(null, ys));
+    var maxY = Math.max.apply(null, ys);
+    if (maxX === minX) {
+      maxX = minX + 1;
+    }
+    if (maxY === minY) {
+      maxY = minY + 1;
+    }
+
+    function x(t) {
+      return pad + (t - minX) / (maxX - minX) * (width - pad - 4);
+    }
+
+    function y(v) {
+      return height - 16 - (v - minY) / (maxY - minY) * (height - 24);
+    }
+
+    var s = svg("svg", { viewBox: "0 0 " + width + " " + height, preserveAspectRatio: "none" });
+    s.appendChild(svg("line", { "class": "axis", x1: pad, y1: y(minY), x2: width, y2: y(minY) }));
+    s.appendChild(svg("line", { "class": "axis", x1: pad, y1: 0, x2: pad, y2: height - 16 }));
+
+    [[minY, y(minY)], [maxY, y(maxY) + 8]].forEach(function (l) {
+      var t = svg("text", { x: 2, y: l[1] });
+      t.textContent = formatValue(l[0]);
+      s.appendChild(t);
+    });
+
+    [[minX, pad, "start"], [maxX, width, "end"]].forEach(function (l) {
+      var t = svg("text", { x: l[1], y: height - 2, "text-anchor": l[2] });
+      t.textContent = new Date(l[0]).toLocaleTimeString();
+      s.appendChild(t);
+    });
+
+    var legend = el("div", { "class": "legend" });
+
+    series.forEach(function (se, i) {
+      var color = colors[i % colors.length];
+      var points = (se.points || []).map(function (p) {
+        return x(Date.parse(p.time)).toFixed(1) + "," + y(value(se, p)).toFixed(1);
+      });
+
+      var line = svg("polyline", { points: points.join(" "), stroke: color });
+      var title = svg("title");
+      title.textContent = se.agent;
+      line.appendChild(title);
+      s.appendChild(line);
+
+      legend.appendChild(el("span", {}, [el("i", { style: "background:" + color }), se.agent]));
+    });
+
+    return el("div", { "class": "chart" }, [
+      el("h3", {}, [name + " (" + series[0].type + ")"]),
+      s,
+      legend
+    ]);
+  }
+
+  // Log templates.
+
+  // templateRow is a row of a list of templates, drilling down into the
+  // template when clicked.
+  function templateRow(template, agent, cells) {
+    var row = el("tr", {}, [el("td", {}, [el("code", {}, [template])])].concat(cells));
+    row.addEventListener("click", function () {
+      $$(".templates tr").forEach(function (r) {
+        r.classList.remove("selected");
+      });
+      row.classList.add("selected");
+      drillDown(template, agent);
+    });
+    return row;
+  }
+
+  function loadTemplates() {
+    var form = $("#logs-form");
+    var span = form.elements.range.value;
+    // Logs have no aggregates across agents.
+    var agent = form.elements.agent.value === "*" ? "" : form.elements.agent.value;
+
+    api("/api/templates" + query({ agent: agent, window: span })).then(function (res) {
+      var growing = $("#growing-rows");
+      growing.textContent = "";
+      (res.growing || []).forEach(function (t) {
+        growing.appendChild(templateRow(t.template, agent, [
+          el("td", { "class": "number" }, [t.count || "0"]),
+          el("td", { "class": "number" }, [t.previous || "0"]),
+          el("td", { "class": "number" }, [t.previous && t.previous !== "0" ? "+" + Math.round((t.growth || 0) * 100) + "%" : "was silent"])
+        ]));
+      });
+
+      var appeared = $("#appeared-rows");
+      appeared.textContent = "";
+      (res.appeared || []).forEach(function (t) {
+        appeared.appendChild(templateRow(t.template, agent, [
+          el("td", { "class": "number" }, [t.count || "0"]),
+          el("td", {}, [formatTime(t.firstSeen)])
+        ]));
+      });
+    }).catch(function (err) {
+      showError($("#drilldown"), err);
+    });
+
+    api("/api/query" + query({
+      name: "*",
+      agent: agent,
+      from: span
+    })).then(function (res) {
+      var counts = {};
+      (res.series || []).forEach(function (s) {
+        if (s.type !== "log") {
+          return;
+        }
+        (s.points || []).forEach(function (p) {
+          counts[s.name] = (counts[s.name] || 0) + (p.sum || 0);
+        });
+      });
+
+      var templates = Object.keys(counts).sort(function (a, b) {
+        return counts[b] - counts[a];
+      });
+
+      var rows = $("#templates-rows");
+      rows.textContent = "";
+      templates.forEach(function (t) {
+        rows.appendChild(templateRow(t, agent, [
+          el("td", { "class": "number" }, [String(counts[t])])
+        ]));
+      });
+    }).catch(function (err) {
+      showError($("#drilldown"), err);
+    });
+  }
+
+  // drillDown shows the most frequent values at every parameter position of
+  // template, counted by the server since it started, and the last messages
+  // of agent it kept.
+  function drillDown(template, agent) {
+    var target = $("#drilldown");
+    target.className = "";
+    target.textContent = "loading…";
+
+    var parameters = api("/api/parameters" + query({ template: template, limit: 20 })).catch(function (err) {
+      // Templates of messages received before the server started are not
+      // tracked.
+      if (err.message.indexOf("404") === 0) {
+        return {};
+      }
+      throw err;
+    });
+    var messages = api("/api/messages" + query({ template: template, agent: agent }));
+
+    Promise.all([parameters, messages]).then(function (results) {
+      var histogram = results[0];
+      var recent = results[1].messages || [];
+
+      target.textContent = "";
+      target.appendChild(el("h3", {}, [el("code", {}, [template])]));
+      target.appendChild(el("p", { "class": "info" }, [(histogram.messages || "0") + " messages counted"]));
+
+      (histogram.positions || []).forEach(function (position, i) {
+        var total = Number(position.total) || 1;
+
+        var table = el("table", {}, [el("thead", {}, [el("tr", {}, [
+          el("th", {}, ["Value"]), el("th", {}, ["Messages"]), el("th", {}, [""])
+        ])])]);
+        var body = el("tbody");
+        (position.values || []).forEach(function (v) {
+          body.appendChild(el("tr", {}, [
+            el("td", {}, [el("code", {}, [v.value])]),
+            el("td", { "class": "number" }, [(position.truncated ? "≤ " : "") + v.count]),
+            el("td", { style: "width:40%" }, [el("div", {
+              "class": "bar",
+              style: "width:" + Math.min(100, 100 * Number(v.count) / total) + "%"
+            })])
+          ]));
+        });
+        table.appendChild(body);
+
+        target.appendChild(el("h4", {}, ["Parameter " + (i + 1)]));
+        target.appendChild(table);
+      });
+
+      var list = el("ol", { "class": "lines" });
+      recent.slice(0, 50).forEach(function (m) {
+        list.appendChild(el("li", { "class": m.level }, [
+          formatTime(m.time) + " " + m.agent + " " + m.level + " " + fill(template, m.parameters || [])
+        ]));
+      });
+      target.appendChild(el("h4", {}, ["Last messages"]));
+      target.appendChild(list);
+    }).catch(function (err) {
+      showError(target, err);
+    });
+  }
+
+  // fill puts the parameters in place of the ?? of template, as the server
+  // formats a message.
+  function fill(template, parameters) {
+    var i = 0;
+    return template.replace(/\?\?/g, function (m) {
+      return i < parameters.length ? parameters[i++] : m;
+    });
+  }
+
+  // Live tail.
+
+  var source = null;
+  var received = 0;
+  var dropped = 0;
+
+  function stopTail() {
+    if (source) {
+      source.close();
+      source = null;
+    }
+    $("#tail-toggle").textContent = "Start";
+  }
+
+  function startTail() {
+    var form = $("#tail-form");
+    var info = $("#tail-info");
+    var lines = $("#tail-lines");
+
+    source = new EventSource("/api/tail" + query({
+      agent: form.elements.agent.value,
+      template: form.elements.template.value,
+      metric: form.elements.metric.value,
+      level: form.elements.level.value,
+      token: token()
+    }));
+
+    $("#tail-toggle").textContent = "Stop";
+    info.className = "info";
+    info.textContent = "connecting…";
+
+    source.onopen = function () {
+      info.textContent = "streaming";
+    };
+
+    source.onerror = function () {
+      info.className = "info error";
+      info.textContent = "disconnected, check the token";
+      stopTail();
+    };
+
+    source.onmessage = function (e) {
+      var u = JSON.parse(e.data);
+      var level = u.level || "INFO";
+      var text = u.type === "log" ? level + " " + u.message
+        : u.type === "suppressed" ? "suppressed " + (u.value || 0) + " " + u.key
+          : u.type + " " + u.key + " = " + formatValue(u.value || 0);
+
+      received++;
+      dropped += Number(u.dropped || 0);
+      info.textContent = "streaming, " + received + " received" + (dropped ? ", " + dropped + " dropped" : "");
+
+      lines.insertBefore(el("li", { "class": u.type === "log" ? level : "" }, [
+        formatTime(u.time) + " " + u.agent + " " + text
+      ]), lines.firstChild);
+
+      while (lines.children.length > maxTailLines) {
+        lines.removeChild(lines.lastChild);
+      }
+    };
+  }
+
+  // Wiring.
+
+  window.addEventListener("hashchange", showView);
+
+  $("#token").addEventListener("click", function () {
+    if (askToken()) {
+      loadAgents();
+    }
+  });
+
+  $("#metrics-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    loadMetrics();
+  });
+
+  $("#metrics-form").elements.range.addEventListener("change", function (e) {
+    $("#metrics-form").classList.toggle("custom-range", e.target.value === "custom");
+  });
+
+  $("#logs-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    loadTemplates();
+  });
+
+  $("#tail-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    if (source) {
+      stopTail();
+    } else {
+      startTail();
+    }
+  });
+
+  $("#tail-clear").addEventListener("click", function () {
+    $("#tail-lines").textContent = "";
+    received = 0;
+    dropped = 0;
+  });
+
+  showView();
+  loadAgents().then(function () {
+    loadMetrics();
+    loadTemplates();
+  });
+  setInterval(loadAgents, 5000);
+})();
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/duanckham/gel/pb"
+)
+
+const dictionaryFile = "templates.jsonl"
+
+type definition struct {
+	Session  string `json:"session"`
+	ID       uint32 `json:"id"`
+	Template string `json:"template"`
+}
+
+// dictionary holds the log templates of every agent session by id. New
+// definitions are appended to a file in the data directory and read back on
+// start, so agents do not resend them after a server restart. Sessions
+// silent for longer than sessionTTL are forgotten, the file is rewritten
+// with the remaining ones on start and every compactAfter definitions.
+type dictionary struct {
+	mu        sync.Mutex
+	sessions  map[string]*sessionTemplates
+	lastPrune time.Time
+	journal   *journal
+}
+
+type sessionTemplates struct {
+	templates map[uint32]string
+	lastSeen  time.Time
+}
+
+func newDictionary(dir string) (*dictionary, error) {
+	d := &dictionary{
+		sessions:  map[string]*sessionTemplates{},
+		lastPrune: time.Now(),
+	}
+
+	if dir == "" {
+		return d, nil
+	}
+
+	j, err := openJournal(filepath.Join(dir, dictionaryFile), func(line []byte) error {
+		def := definition{}
+		if err := json.Unmarshal(line, &def); err != nil {
+			return err
+		}
+
+		d.set(def)
+
+		return nil
+	}, d.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	d.journal = j
+
+	return d, nil
+}
+
+func (d *dictionary) session(session string) *sessionTemplates {
+	st, ok := d.sessions[session]
+	if !ok {
+		st = &sessionTemplates{
+			templates: map[uint32]string{},
+		}
+
+		d.sessions[session] = st
+	}
+
+	st.lastSeen = time.Now()
+
+	return st
+}
+
+func (d *dictionary) set(def definition) {
+	d.session(def.Session).templates[def.ID] = def.Template
+}
+
+// define records the templates carried by r.
+func (d *dictionary) define(r *pb.Record, st *sessionTemplates) error {
+	for id, template := range r.Templates {
+		if t, ok := st.templates[id]; ok && t == template {
+			continue
+		}
+
+		def := definition{
+			Session:  r.Session,
+			ID:       id,
+			Template: template,
+		}
+
+		if err := d.journal.append(def); err != nil {
+			return err
+		}
+
+		st.templates[id] = template
+	}
+
+	return nil
+}
+
+// entries writes the templates of the sessions still known.
+func (d *dictionary) entries(write func(v interface{})) {
+	for session, st := range d.sessions {
+		for id, template := range st.templates {
+			write(definition{
+				Session:  session,
+				ID:       id,
+				Template: template,
+			})
+		}
+	}
+}
+
+func (d *dictionary) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < time.Minute {
+		return
+	}
+
+	d.lastPrune = now
+
+	for session, st := range d.sessions {
+		if now.Sub(st.lastSeen) > sessionTTL {
+			delete(d.sessions, session)
+		}
+	}
+}
+
+// resolve moves the template logs of r back to its logs, keyed by template.
+// It fails with FailedPrecondition when an id is unknown, which tells the
+// agent to send its definitions again.
+func (d *dictionary) resolve(r *pb.Record) error {
+	if len(r.Templates) == 0 && len(r.TemplateLogs) == 0 {
+		return nil
+	}
+
+	defer d.mu.Unlock()
+	d.mu.Lock()
+
+	d.prune(time.Now())
+
+	st := d.session(r.Session)
+
+	if err := d.define(r, st); err != nil {
+		return status.Errorf(codes.Internal, "persist templates: %v", err)
+	}
+
+	if len(r.TemplateLogs) == 0 {
+		return nil
+	}
+
+	unknown := []uint32{}
+
+	for id := range r.TemplateLogs {
+		if _, ok := st.templates[id]; !ok {
+			unknown = append(unknown, id)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "unknown template ids %v in session %q", unknown, r.Session)
+	}
+
+	if r.Logs == nil {
+		r.Logs = map[string]*pb.Logs{}
+	}
+
+	for id, logs := range r.TemplateLogs {
+		template := st.templates[id]
+
+		if v, ok := r.Logs[template]; ok {
+			v.Logs = append(v.Logs, logs.Logs...)
+			v.Suppressed += logs.Suppressed
+		} else {
+			r.Logs[template] = logs
+		}
+	}
+
+	r.Templates = nil
+	r.TemplateLogs = nil
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/duanckham/gel/pb"
+)
+
+const firstSeenFile = "first_seen.jsonl"
+
+// maxFirstSeen bounds the templates whose first seen date is kept, the ones
+// received the longest ago are forgotten first.
+const maxFirstSeen = 10000
+
+type sighting struct {
+	Template  string    `json:"template"`
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+type seenTemplate struct {
+	first time.Time
+	last  time.Time
+}
+
+// firstSeen remembers when every log template was first received. As the
+// store is kept in memory only, the dates are appended to a file in the data
+// directory and read back on start, so a template received before a restart
+// is not taken for a new one after it. Templates not received for longer
+// than ttl are forgotten, as are the least recently received ones past
+// maxFirstSeen.
+type firstSeen struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	templates map[string]*seenTemplate
+	lastPrune time.Time
+	journal   *journal
+}
+
+func newFirstSeen(dir string, ttl time.Duration) (*firstSeen, error) {
+	fs := &firstSeen{
+		ttl:       ttl,
+		templates: map[string]*seenTemplate{},
+		lastPrune: time.Now(),
+	}
+
+	if dir == "" {
+		return fs, nil
+	}
+
+	now := time.Now()
+
+	j, err := openJournal(filepath.Join(dir, firstSeenFile), func(line []byte) error {
+		s := sighting{}
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+
+		if t, ok := fs.templates[s.Template]; ok && !s.FirstSeen.Before(t.first) {
+			return nil
+		}
+
+		fs.templates[s.Template] = &seenTemplate{
+			first: s.FirstSeen,
+			last:  now,
+		}
+
+		return nil
+	}, fs.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.journal = j
+
+	return fs, nil
+}
+
+// add records the log templates of r as received now.
+func (fs *firstSeen) add(r *pb.Record) {
+	if len(r.Logs) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	defer fs.mu.Unlock()
+	fs.mu.Lock()
+
+	fs.prune(now)
+
+	for template := range r.Logs {
+		if t, ok := fs.templates[template]; ok {
+			t.last = now
+			continue
+		}
+
+		if len(fs.templates) >= maxFirstSeen {
+			fs.evict()
+		}
+
+		fs.templates[template] = &seenTemplate{
+			first: now,
+			last:  now,
+		}
+
+		if err := fs.journal.append(sighting{Template: template, FirstSeen: now}); err != nil {
+			fmt.Println("* first seen persist err:", err)
+		}
+	}
+}
+
+// evict forgets the template received the longest ago.
+func (fs *firstSeen) evict() {
+	oldest := ""
+	var last time.Time
+
+	for template, t := range fs.templates {
+		if oldest == "" || t.last.Before(last) {
+			oldest = template
+			last = t.last
+		}
+	}
+
+	delete(fs.templates, oldest)
+}
+
+// earliest moves the first seen of every count back to the date remembered,
+// when it is earlier than the points kept.
+func (fs *firstSeen) earliest(counts []*templateCount) {
+	defer fs.mu.Unlock()
+	fs.mu.Lock()
+
+	for _, c := range counts {
+		if t, ok := fs.templates[c.Template]; ok && t.first.Before(c.FirstSeen) {
+			c.FirstSeen = t.first
+		}
+	}
+}
+
+// entries writes the first seen of the templates still known.
+func (fs *firstSeen) entries(write func(v interface{})) {
+	for template, t := range fs.templates {
+		write(sighting{
+			Template:  template,
+			FirstSeen: t.first,
+		})
+	}
+}
+
+func (fs *firstSeen) prune(now time.Time) {
+	if now.Sub(fs.lastPrune) < time.Minute {
+		return
+	}
+
+	fs.lastPrune = now
+
+	for template, t := range fs.templates {
+		if now.Sub(t.last) > fs.ttl {
+			delete(fs.templates, template)
+		}
+	}
+}
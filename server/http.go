@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// RecordsPath is the path of the HTTP endpoint ingesting records.
+const RecordsPath = "/v1/records"
+
+// maxHTTPBody bounds the size of a request to the HTTP endpoint.
+const maxHTTPBody = 16 << 20
+
+// httpAddr is the address of an HTTP client, to tell agents apart as the
+// peer of a gRPC call does.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// HTTPHandler returns the HTTP endpoint for the producers that cannot speak
+// gRPC. A POST to RecordsPath takes a pb.Record in JSON, or one per line
+// when the content type is application/x-ndjson or the format parameter is
+// ndjson, and answers the pb.SyncResponse in JSON. Records go through the
+// same validation and ingestion as SyncRecords. The token goes in the
+// Authorization header, or in the token parameter for browser beacons.
+// The dashboard is served too when enabled, see WithDashboard.
+func (gs *GelServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(RecordsPath, gs.serveRecords)
+
+	if gs.recent != nil {
+		gs.registerDashboard(mux)
+	}
+
+	return mux
+}
+
+func (gs *GelServer) serveRecords(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case http.MethodPost:
+
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		httpError(w, status.Error(codes.Unimplemented, "method not allowed"))
+		return
+	}
+
+	if !gs.allowed(authorization(r)) {
+		httpError(w, status.Error(codes.Unauthenticated, "missing or unknown token"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBody))
+	if err != nil {
+		httpError(w, status.Errorf(codes.InvalidArgument, "read body: %v", err))
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := contentType == "application/x-ndjson" || r.URL.Query().Get("format") == "ndjson"
+
+	records, err := decodeRecords(body, ndjson)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	ctx := peer.NewContext(r.Context(), &peer.Peer{
+		Addr: httpAddr(r.RemoteAddr),
+	})
+
+	res, err := gs.sync(ctx, records)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	b, _ := protojson.Marshal(res)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// authorization returns the Authorization header of r, or the bearer token
+// of its token parameter.
+func authorization(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return bearerPrefix + token
+	}
+
+	return r.Header.Get("Authorization")
+}
+
+func decodeRecords(body []byte, ndjson bool) ([]*pb.Record, error) {
+	if !ndjson {
+		rec := &pb.Record{}
+		if err := protojson.Unmarshal(body, rec); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "record: %v", err)
+		}
+
+		return []*pb.Record{rec}, nil
+	}
+
+	records := []*pb.Record{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, maxHTTPBody)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		rec := &pb.Record{}
+		if err := protojson.Unmarshal(line, rec); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "record on line %d: %v", n, err)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "records: %v", err)
+	}
+
+	return records, nil
+}
+
+// httpError writes err with the HTTP status matching its gRPC code.
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		code = http.StatusBadRequest
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.Unimplemented:
+		code = http.StatusMethodNotAllowed
+	}
+
+	http.Error(w, status.Convert(err).Message(), code)
+}
+
+// serveHTTP serves the HTTP endpoint of gs on l.
+func serveHTTP(gs *GelServer, l net.Listener) {
+	fmt.Println("* gel http endpoint listening on", l.Addr())
+
+	if err := http.Serve(l, gs.HTTPHandler()); err != nil {
+		fmt.Println("* http.Serve err:", err)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// compactAfter is the number of lines appended to a journal before it is
+// rewritten with the entries still live only.
+const compactAfter = 100000
+
+// journal keeps the state of the server across restarts in a file of JSON
+// lines, one per entry. Entries are appended as they come, the file is
+// rewritten with the live ones on open and every compactAfter lines. A nil
+// journal, without a data directory, keeps nothing.
+type journal struct {
+	path     string
+	file     *os.File
+	appended int
+	// entries writes every live entry, for the compaction.
+	entries func(write func(v interface{}))
+}
+
+// openJournal reads the lines of the journal at path back with load, then
+// compacts it.
+func openJournal(path string, load func(line []byte) error, entries func(write func(v interface{}))) (*journal, error) {
+	j := &journal{
+		path:    path,
+		entries: entries,
+	}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+
+		for scanner.Scan() {
+			// A torn last line after a crash fails, skip it.
+			load(scanner.Bytes())
+		}
+
+		f.Close()
+	}
+
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// append writes v as a line of the journal.
+func (j *journal) append(v interface{}) error {
+	if j == nil || j.file == nil {
+		return nil
+	}
+
+	b, _ := json.Marshal(v)
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	j.appended++
+	if j.appended >= compactAfter {
+		if err := j.compact(); err != nil {
+			fmt.Println("* journal compact err:", j.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the journal with the live entries, then appends to it.
+func (j *journal) compact() error {
+	tmp := j.path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+
+	j.entries(func(v interface{}) {
+		b, _ := json.Marshal(v)
+		w.Write(append(b, '\n'))
+	})
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	j.appended = 0
+
+	return err
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// Bounds of the messages kept for the drill down of the dashboard.
+const (
+	recentPerTemplate = 200
+	recentTemplates   = 10000
+)
+
+// message is a log message as kept by recent.
+type message struct {
+	Time       time.Time `json:"time"`
+	Agent      string    `json:"agent"`
+	Level      string    `json:"level"`
+	Parameters []string  `json:"parameters"`
+}
+
+// recentRing holds the last messages of a template, oldest first once
+// full at next.
+type recentRing struct {
+	messages []message
+	next     int
+	updated  time.Time
+}
+
+// recent keeps the last messages of every template, the templates not
+// updated for the longest are forgotten past recentTemplates.
+type recent struct {
+	mu        sync.Mutex
+	templates map[string]*recentRing
+}
+
+func newRecent() *recent {
+	return &recent{
+		templates: map[string]*recentRing{},
+	}
+}
+
+func (rc *recent) add(r *pb.Record) {
+	if len(r.Logs) == 0 {
+		return
+	}
+
+	start, err := ptypes.Timestamp(r.Start)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	defer rc.mu.Unlock()
+	rc.mu.Lock()
+
+	for template, logs := range r.Logs {
+		ring, ok := rc.templates[template]
+		if !ok {
+			if len(rc.templates) >= recentTemplates {
+				rc.evict()
+			}
+
+			ring = &recentRing{}
+			rc.templates[template] = ring
+		}
+
+		ring.updated = now
+
+		for _, m := range logs.Logs {
+			msg := message{
+				Time:       start.Add(time.Duration(m.Offset)),
+				Agent:      r.Session,
+				Level:      m.Level.String(),
+				Parameters: m.Parameters,
+			}
+
+			if len(ring.messages) < recentPerTemplate {
+				ring.messages = append(ring.messages, msg)
+				continue
+			}
+
+			ring.messages[ring.next] = msg
+			ring.next = (ring.next + 1) % recentPerTemplate
+		}
+	}
+}
+
+// evict forgets the template updated the longest ago.
+func (rc *recent) evict() {
+	oldest := ""
+	var updated time.Time
+
+	for template, ring := range rc.templates {
+		if oldest == "" || ring.updated.Before(updated) {
+			oldest = template
+			updated = ring.updated
+		}
+	}
+
+	delete(rc.templates, oldest)
+}
+
+// list returns the messages kept of template, of agent or of every agent
+// when empty, the last first.
+func (rc *recent) list(template, agent string) []message {
+	defer rc.mu.Unlock()
+	rc.mu.Lock()
+
+	ring, ok := rc.templates[template]
+	if !ok {
+		return []message{}
+	}
+
+	n := len(ring.messages)
+	list := make([]message, 0, n)
+
+	for i := 0; i < n; i++ {
+		m := ring.messages[(ring.next+n-1-i)%n]
+		if agent != "" && m.Agent != agent {
+			continue
+		}
+
+		list = append(list, m)
+	}
+
+	return list
+}
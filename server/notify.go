@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults of the notifiers.
+const (
+	DefaultNotifyAttempts = 3
+	DefaultNotifyBackoff  = time.Second
+	DefaultGroupWait      = 10 * time.Second
+)
+
+// notifyQueue bounds the alerts waiting for a notifier, the rules never
+// wait for a notifier.
+const notifyQueue = 1024
+
+// Notification is a group of alerts of a rule, sent at once to a target.
+type Notification struct {
+	Rule   string  `json:"rule"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// Target delivers notifications, see NewWebhook, NewSlack and NewSMTP.
+type Target interface {
+	Send(n Notification) error
+}
+
+// Silence mutes the alerts it matches between Start and End. Rule, Series
+// and Agent are glob patterns, empty ones match everything.
+type Silence struct {
+	Rule    string
+	Series  string
+	Agent   string
+	Start   time.Time
+	End     time.Time
+	Comment string
+}
+
+func (s Silence) matches(a Alert, now time.Time) bool {
+	if now.Before(s.Start) || !now.Before(s.End) {
+		return false
+	}
+
+	for _, m := range [][2]string{{s.Rule, a.Rule}, {s.Series, a.Series}, {s.Agent, a.Agent}} {
+		if m[0] != "" && !glob(m[0]).MatchString(m[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dispatcher groups the alerts notified to it and sends them to a target.
+type dispatcher struct {
+	target    Target
+	alerts    chan Alert
+	attempts  int
+	backoff   time.Duration
+	groupWait time.Duration
+	limit     int
+	per       time.Duration
+	sent      []time.Time
+	silences  []Silence
+}
+
+// NotifyOption configures a notifier.
+type NotifyOption func(*dispatcher)
+
+// WithRetry sets how many times a notification is attempted, waiting
+// backoff after the first failure and twice as long after every next one.
+func WithRetry(attempts int, backoff time.Duration) NotifyOption {
+	return func(d *dispatcher) {
+		if attempts < 1 {
+			attempts = 1
+		}
+
+		d.attempts = attempts
+		d.backoff = backoff
+	}
+}
+
+// WithRateLimit drops the notifications past n per interval.
+func WithRateLimit(n int, per time.Duration) NotifyOption {
+	return func(d *dispatcher) {
+		d.limit = n
+		d.per = per
+	}
+}
+
+// WithGroupWait sets how long alerts are collected before being sent, the
+// alerts of a rule collected together make a single notification.
+func WithGroupWait(wait time.Duration) NotifyOption {
+	return func(d *dispatcher) {
+		d.groupWait = wait
+	}
+}
+
+// WithSilence mutes the alerts matched by s.
+func WithSilence(s Silence) NotifyOption {
+	return func(d *dispatcher) {
+		d.silences = append(d.silences, s)
+	}
+}
+
+// NewNotifier returns a Notifier sending the alerts to target.
+func NewNotifier(target Target, opts ...NotifyOption) Notifier {
+	d := &dispatcher{
+		target:    target,
+		alerts:    make(chan Alert, notifyQueue),
+		attempts:  DefaultNotifyAttempts,
+		backoff:   DefaultNotifyBackoff,
+		groupWait: DefaultGroupWait,
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	go d.run()
+
+	return d
+}
+
+// Notify queues a, unless it is silenced.
+func (d *dispatcher) Notify(a Alert) error {
+	now := time.Now()
+
+	for _, s := range d.silences {
+		if s.matches(a, now) {
+			return nil
+		}
+	}
+
+	select {
+	case d.alerts <- a:
+		return nil
+	default:
+		return fmt.Errorf("notifier queue full, alert dropped")
+	}
+}
+
+func (d *dispatcher) run() {
+	for a := range d.alerts {
+		groups := map[string][]Alert{
+			a.Rule: {a},
+		}
+
+		rules := []string{a.Rule}
+		t := time.NewTimer(d.groupWait)
+
+	collect:
+		for {
+			select {
+			case a := <-d.alerts:
+				if _, ok := groups[a.Rule]; !ok {
+					rules = append(rules, a.Rule)
+				}
+
+				groups[a.Rule] = append(groups[a.Rule], a)
+
+			case <-t.C:
+				break collect
+			}
+		}
+
+		for _, rule := range rules {
+			d.send(Notification{
+				Rule:   rule,
+				Alerts: groups[rule],
+			})
+		}
+	}
+}
+
+// allow tells whether the rate limit leaves room for a notification.
+func (d *dispatcher) allow(now time.Time) bool {
+	if d.limit <= 0 {
+		return true
+	}
+
+	i := 0
+	for i < len(d.sent) && now.Sub(d.sent[i]) >= d.per {
+		i++
+	}
+
+	d.sent = d.sent[i:]
+
+	if len(d.sent) >= d.limit {
+		return false
+	}
+
+	d.sent = append(d.sent, now)
+
+	return true
+}
+
+func (d *dispatcher) send(n Notification) {
+	if !d.allow(time.Now()) {
+		fmt.Println("* notify rate limited:", n.Rule, len(n.Alerts), "alerts dropped")
+		return
+	}
+
+	backoff := d.backoff
+
+	for attempt := 1; ; attempt++ {
+		err := d.target.Send(n)
+		if err == nil {
+			return
+		}
+
+		if attempt >= d.attempts {
+			fmt.Println("* notify err:", n.Rule, err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
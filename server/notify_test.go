@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer receives the notifications posted to it, failing the first
+// fail requests with a 500.
+func webhookServer(t *testing.T, fail int32) (url string, received chan Notification, requests *int32) {
+	received = make(chan Notification, 16)
+	requests = new(int32)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		n := Notification{}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("payload: %v", err)
+		}
+
+		received <- n
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s.URL, received, requests
+}
+
+func webhookNotifier(t *testing.T, url string, opts ...NotifyOption) Notifier {
+	target, err := NewWebhook(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewNotifier(target, opts...)
+}
+
+func firing(rule, series string) Alert {
+	return Alert{
+		Rule:   rule,
+		Series: series,
+		Agent:  "api-1",
+		State:  AlertFiring,
+		Value:  1,
+		Since:  time.Now(),
+		At:     time.Now(),
+	}
+}
+
+func receive(t *testing.T, received chan Notification) Notification {
+	select {
+	case n := <-received:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+
+	return Notification{}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	url, received, requests := webhookServer(t, 2)
+	n := webhookNotifier(t, url, WithRetry(3, time.Millisecond), WithGroupWait(time.Millisecond))
+
+	if err := n.Notify(firing("cpu", "cpu.load")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receive(t, received)
+	if got.Rule != "cpu" || len(got.Alerts) != 1 || got.Alerts[0].Series != "cpu.load" {
+		t.Errorf("notification %+v", got)
+	}
+
+	if r := atomic.LoadInt32(requests); r != 3 {
+		t.Errorf("%d requests, want 3", r)
+	}
+}
+
+func TestWebhookRetryGivesUp(t *testing.T) {
+	url, received, requests := webhookServer(t, 10)
+	n := webhookNotifier(t, url, WithRetry(2, time.Millisecond), WithGroupWait(time.Millisecond))
+
+	n.Notify(firing("cpu", "cpu.load"))
+
+	select {
+	case got := <-received:
+		t.Fatalf("notification %+v delivered past the failures", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if r := atomic.LoadInt32(requests); r != 2 {
+		t.Errorf("%d requests, want 2", r)
+	}
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	url, received, _ := webhookServer(t, 0)
+	n := webhookNotifier(t, url, WithRateLimit(1, time.Hour), WithGroupWait(time.Millisecond))
+
+	n.Notify(firing("cpu", "cpu.load"))
+	receive(t, received)
+
+	n.Notify(firing("disk", "disk.used"))
+
+	select {
+	case got := <-received:
+		t.Errorf("notification %+v past the rate limit", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNotifyGrouping(t *testing.T) {
+	url, received, _ := webhookServer(t, 0)
+	n := webhookNotifier(t, url, WithGroupWait(100*time.Millisecond))
+
+	n.Notify(firing("cpu", "cpu.load"))
+	n.Notify(firing("disk", "disk.used"))
+	n.Notify(firing("cpu", "cpu.steal"))
+
+	first := receive(t, received)
+	second := receive(t, received)
+
+	if first.Rule != "cpu" || len(first.Alerts) != 2 {
+		t.Errorf("first notification %+v, want the 2 alerts of cpu", first)
+	}
+
+	if second.Rule != "disk" || len(second.Alerts) != 1 {
+		t.Errorf("second notification %+v, want the alert of disk", second)
+	}
+}
+
+func TestNotifySilence(t *testing.T) {
+	url, received, _ := webhookServer(t, 0)
+	n := webhookNotifier(t, url, WithGroupWait(time.Millisecond), WithSilence(Silence{
+		Series: "disk.*",
+		Start:  time.Now().Add(-time.Minute),
+		End:    time.Now().Add(time.Hour),
+	}))
+
+	n.Notify(firing("disk", "disk.used"))
+	n.Notify(firing("cpu", "cpu.load"))
+
+	if got := receive(t, received); got.Rule != "cpu" {
+		t.Errorf("notification %+v, want cpu only", got)
+	}
+}
+
+// smtpServer accepts a single mail and sends its data on the channel.
+func smtpServer(t *testing.T) (addr string, data chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	data = make(chan string, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		reply("220 localhost")
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+
+			case strings.HasPrefix(command, "DATA"):
+				reply("354 go ahead")
+
+				b := &strings.Builder{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					if line == ".\r\n" {
+						break
+					}
+
+					b.WriteString(line)
+				}
+
+				data <- b.String()
+				reply("250 queued")
+
+			case strings.HasPrefix(command, "QUIT"):
+				reply("221 bye")
+				return
+
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), data
+}
+
+func TestSMTPPayload(t *testing.T) {
+	addr, data := smtpServer(t)
+
+	target, err := NewSMTP(SMTPConfig{
+		Addr: addr,
+		From: "gel@example.com",
+		To:   []string{"ops@example.com", "dev@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := firing("cpu", "cpu.steal")
+	resolved.State = AlertResolved
+
+	err = target.Send(Notification{
+		Rule:   "cpu",
+		Alerts: []Alert{firing("cpu", "cpu.load"), resolved},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mail string
+	select {
+	case mail = <-data:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+
+	for _, want := range []string{
+		"From: gel@example.com\r\n",
+		"To: ops@example.com, dev@example.com\r\n",
+		"Subject: [gel] cpu: 1 firing, 1 resolved\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n",
+		"[firing] cpu cpu.load api-1 value=1 since=",
+		"[resolved] cpu cpu.steal api-1 value=1 since=",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail misses %q:\n%s", want, mail)
+		}
+	}
+
+	if strings.Contains(strings.Replace(mail, "\r\n", "", -1), "\n") {
+		t.Errorf("mail has bare line feeds:\n%s", mail)
+	}
+}
+
+func TestSMTPSubjectLineBreaks(t *testing.T) {
+	addr, data := smtpServer(t)
+
+	target, err := NewSMTP(SMTPConfig{
+		Addr: addr,
+		From: "gel@example.com",
+		To:   []string{"ops@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := "cpu\r\nBcc: all@example.com"
+
+	if err := target.Send(Notification{Rule: rule, Alerts: []Alert{firing(rule, "cpu.load")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mail string
+	select {
+	case mail = <-data:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+
+	if !strings.Contains(mail, "Subject: [gel] cpuBcc: all@example.com: 1 firing\r\n") {
+		t.Errorf("mail has a header injected:\n%s", mail)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"time"
+)
+
+type options struct {
+	dataDir     string
+	bucketWidth time.Duration
+	grace       time.Duration
+	percentiles []float64
+	dedupe      uint64
+	tiers       []Tier
+	tokens      map[string]bool
+	httpAddr    string
+	dashboard   bool
+	relay       *relayOptions
+
+	rules        []Rule
+	notifiers    []Notifier
+	ruleInterval time.Duration
+}
+
+// Option configures a server.
+type Option func(*options)
+
+// WithDataDir sets the directory where the server persists its state. The
+// state is kept in memory only when it is not set.
+func WithDataDir(dir string) Option {
+	return func(o *options) {
+		o.dataDir = dir
+	}
+}
+
+// WithBucketWidth sets the width of the time buckets summing the records of
+// every agent, see DefaultBucketWidth.
+func WithBucketWidth(width time.Duration) Option {
+	return func(o *options) {
+		o.bucketWidth = width
+	}
+}
+
+// WithGrace sets how long after its end a bucket waits for late records
+// before its aggregates across agents are stored, the bucket width by
+// default. Records arriving later only count for their agent.
+func WithGrace(grace time.Duration) Option {
+	return func(o *options) {
+		o.grace = grace
+	}
+}
+
+// WithPercentiles sets the percentiles, between 0 and 100, of the instants
+// across agents, see DefaultPercentiles.
+func WithPercentiles(percentiles ...float64) Option {
+	return func(o *options) {
+		o.percentiles = percentiles
+	}
+}
+
+// WithDedupeWindow sets how many sequence numbers of every agent session are
+// remembered to drop records delivered twice, see DefaultDedupeWindow.
+func WithDedupeWindow(n uint64) Option {
+	return func(o *options) {
+		o.dedupe = n
+	}
+}
+
+// WithRetention sets the tiers of the store, see DefaultTiers. The first
+// keeps the raw points and has a zero resolution, every other resolution is
+// a multiple of the one before. The store is kept in memory, the data
+// directory included, so its points do not outlive the server.
+func WithRetention(tiers ...Tier) Option {
+	return func(o *options) {
+		o.tiers = tiers
+	}
+}
+
+// WithRules adds alerting rules, evaluated over the store.
+func WithRules(rules ...Rule) Option {
+	return func(o *options) {
+		o.rules = append(o.rules, rules...)
+	}
+}
+
+// WithNotifier adds a notifier of the alerts, they are printed when there
+// is none.
+func WithNotifier(n Notifier) Option {
+	return func(o *options) {
+		o.notifiers = append(o.notifiers, n)
+	}
+}
+
+// WithRuleInterval sets how often the rules are evaluated, see
+// DefaultRuleInterval.
+func WithRuleInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.ruleInterval = interval
+	}
+}
+
+// WithTokens requires every call to carry one of tokens, as a bearer token
+// in the authorization metadata or header.
+func WithTokens(tokens ...string) Option {
+	return func(o *options) {
+		if o.tokens == nil {
+			o.tokens = map[string]bool{}
+		}
+
+		for _, t := range tokens {
+			o.tokens[t] = true
+		}
+	}
+}
+
+// WithHTTPAddr makes New and Serve serve HTTPHandler on addr as well.
+func WithHTTPAddr(addr string) Option {
+	return func(o *options) {
+		o.httpAddr = addr
+	}
+}
+
+// WithDashboard serves a web dashboard at DashboardPath of HTTPHandler,
+// next to the JSON API it is built on under /api/. The last messages of
+// every template are kept in memory for it.
+func WithDashboard() Option {
+	return func(o *options) {
+		o.dashboard = true
+	}
+}
+
+// WithRelay makes the server a relay to the gel server at upstream, as
+// "host:port". Records accepted are still ingested, and also spooled under
+// the data directory, which must be set, then forwarded with their session,
+// sequence number and agent address until upstream accepts them.
+func WithRelay(upstream string, opts ...RelayOption) Option {
+	return func(o *options) {
+		o.relay = &relayOptions{
+			upstream:   upstream,
+			spoolLimit: DefaultSpoolLimit,
+		}
+
+		for _, opt := range opts {
+			opt(o.relay)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+
+	"github.com/duanckham/gel/gel"
+	"github.com/duanckham/gel/pb"
+)
+
+// Attributes of the OTLP log records carrying a gel template and its
+// parameters, the body being the formatted message.
+const (
+	OTLPTemplateAttribute   = "gel.template"
+	OTLPParametersAttribute = "gel.parameters"
+)
+
+// OTLPLogTemplate is the template of the OTLP log records without a
+// gel.template attribute, their body being its only parameter. Bodies
+// are not taken as templates, every line would be a template of its own.
+const OTLPLogTemplate = "??"
+
+// OTLPSession is the session of the OTLP resources without a
+// service.instance.id nor a service.name attribute.
+const OTLPSession = "otlp"
+
+// RegisterOTLP registers the OTLP/gRPC metrics and logs services on s, next
+// to the gel service, so OpenTelemetry SDKs and collectors can export to
+// the server. Every resource is ingested as a record of the session named
+// by its service.instance.id attribute, or else its service.name.
+//
+// Data points map to gel as follows, their attributes becoming tags:
+//
+//	delta sum              number
+//	monotonic cumulative   number, the increase since the previous point
+//	other cumulative sum   instant
+//	gauge                  instant
+//	histogram              number distribution, as gel.Observe records it
+//
+// Numbers are integers, a sum of a record that is not, such as a duration
+// in seconds, is kept as an instant holding the sum rather than rounded.
+// The interval of a cumulative point is the one since the previous point,
+// not since the start of the series.
+//
+// Exponential histograms and summaries are rejected. A log record becomes a
+// message of the template in its gel.template attribute, with the
+// parameters in gel.parameters, or else of OTLPLogTemplate with its body.
+func (gs *GelServer) RegisterOTLP(s *grpc.Server) {
+	colmetricspb.RegisterMetricsServiceServer(s, &otlpMetrics{
+		gs:         gs,
+		cumulative: newCumulative(),
+	})
+
+	collogspb.RegisterLogsServiceServer(s, &otlpLogs{
+		gs: gs,
+	})
+}
+
+type otlpMetrics struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	gs         *GelServer
+	cumulative *cumulative
+}
+
+// Export endpoint receive OTLP metrics.
+func (s *otlpMetrics) Export(ctx context.Context, in *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if err := s.gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	records := []*pb.Record{}
+	rejected := int64(0)
+
+	for _, rm := range in.ResourceMetrics {
+		b := newRecordBuilder(resourceSession(rm.Resource))
+
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				rejected += s.add(b, m)
+			}
+		}
+
+		if r := b.record(); r != nil {
+			records = append(records, r)
+		}
+	}
+
+	if _, err := s.gs.sync(ctx, records); err != nil {
+		return nil, err
+	}
+
+	res := &colmetricspb.ExportMetricsServiceResponse{}
+
+	if rejected > 0 {
+		res.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       "exponential histograms, summaries, unnamed metrics and non-finite values are not supported",
+		}
+	}
+
+	return res, nil
+}
+
+// add adds the points of m to b, it returns the number of points rejected.
+func (s *otlpMetrics) add(b *recordBuilder, m *metricspb.Metric) int64 {
+	rejected := int64(0)
+
+	switch data := m.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		for _, p := range data.Gauge.DataPoints {
+			if p.Flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+				continue
+			}
+
+			if m.Name == "" || !b.instant(gel.TaggedName(m.Name, tags(p.Attributes)...), numberValue(p), p.TimeUnixNano) {
+				rejected++
+			}
+		}
+
+	case *metricspb.Metric_Sum:
+		sum := data.Sum
+		cumulative := sum.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+
+		for _, p := range sum.DataPoints {
+			if p.Flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+				continue
+			}
+
+			name := gel.TaggedName(m.Name, tags(p.Attributes)...)
+			v := numberValue(p)
+
+			switch {
+			case m.Name == "" || math.IsNaN(v) || math.IsInf(v, 0):
+				rejected++
+
+			case !cumulative:
+				b.number(name, v, p.StartTimeUnixNano, p.TimeUnixNano)
+
+			case sum.IsMonotonic:
+				delta, since := s.cumulative.delta(b.session, name, p.StartTimeUnixNano, p.TimeUnixNano, v)
+				b.number(name, delta, since, p.TimeUnixNano)
+
+			default:
+				b.instant(name, v, p.TimeUnixNano)
+			}
+		}
+
+	case *metricspb.Metric_Histogram:
+		h := data.Histogram
+		cumulative := h.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+
+		for _, p := range h.DataPoints {
+			if p.Flags&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+				continue
+			}
+
+			if m.Name == "" || len(p.BucketCounts) > len(p.ExplicitBounds)+1 {
+				rejected++
+				continue
+			}
+
+			t := tags(p.Attributes)
+
+			values := map[string]float64{
+				gel.TaggedName(m.Name+".count", t...): float64(p.Count),
+				gel.TaggedName(m.Name+".sum", t...):   p.GetSum(),
+			}
+
+			for i, c := range p.BucketCounts {
+				le := "+Inf"
+				if i < len(p.ExplicitBounds) {
+					le = strconv.FormatFloat(p.ExplicitBounds[i], 'f', -1, 64)
+				}
+
+				values[gel.TaggedName(m.Name+".bucket", append(t[:len(t):len(t)], "le", le)...)] = float64(c)
+			}
+
+			for name, v := range values {
+				if !cumulative {
+					b.number(name, v, p.StartTimeUnixNano, p.TimeUnixNano)
+					continue
+				}
+
+				delta, since := s.cumulative.delta(b.session, name, p.StartTimeUnixNano, p.TimeUnixNano, v)
+				b.number(name, delta, since, p.TimeUnixNano)
+			}
+		}
+
+	case *metricspb.Metric_ExponentialHistogram:
+		rejected += int64(len(data.ExponentialHistogram.DataPoints))
+
+	case *metricspb.Metric_Summary:
+		rejected += int64(len(data.Summary.DataPoints))
+	}
+
+	return rejected
+}
+
+type otlpLogs struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	gs *GelServer
+}
+
+// Export endpoint receive OTLP logs.
+func (s *otlpLogs) Export(ctx context.Context, in *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := s.gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	records := []*pb.Record{}
+	rejected := int64(0)
+
+	for _, rl := range in.ResourceLogs {
+		b := newRecordBuilder(resourceSession(rl.Resource))
+
+		for _, sl := range rl.ScopeLogs {
+			for _, l := range sl.LogRecords {
+				if !b.log(l) {
+					rejected++
+				}
+			}
+		}
+
+		if r := b.record(); r != nil {
+			records = append(records, r)
+		}
+	}
+
+	if _, err := s.gs.sync(ctx, records); err != nil {
+		return nil, err
+	}
+
+	res := &collogspb.ExportLogsServiceResponse{}
+
+	if rejected > 0 {
+		res.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: rejected,
+			ErrorMessage:       "log records without body nor template",
+		}
+	}
+
+	return res, nil
+}
+
+// recordBuilder gathers the data of an OTLP resource into a record.
+type recordBuilder struct {
+	session string
+	start   uint64
+	end     uint64
+	r       *pb.Record
+	logs    []*logsEntry
+	// numbers are summed before they are known to be integers.
+	numbers map[string]float64
+}
+
+// logsEntry is a log message waiting for the start of the record, its
+// offset is relative to it.
+type logsEntry struct {
+	template string
+	message  *pb.Message
+	time     uint64
+}
+
+func newRecordBuilder(session string) *recordBuilder {
+	return &recordBuilder{
+		session: session,
+		numbers: map[string]float64{},
+		r: &pb.Record{
+			Session:  session,
+			Numbers:  map[string]int64{},
+			Instants: map[string]float64{},
+			Logs:     map[string]*pb.Logs{},
+		},
+	}
+}
+
+// cover extends the interval of the record to the times given, zero ones
+// being unknown.
+func (b *recordBuilder) cover(times ...uint64) {
+	for _, t := range times {
+		if t == 0 {
+			continue
+		}
+
+		if b.start == 0 || t < b.start {
+			b.start = t
+		}
+
+		if t > b.end {
+			b.end = t
+		}
+	}
+}
+
+func (b *recordBuilder) number(name string, v float64, start, end uint64) {
+	b.numbers[name] += v
+	b.cover(start, end)
+}
+
+func (b *recordBuilder) instant(name string, v float64, t uint64) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return false
+	}
+
+	b.r.Instants[name] = v
+	b.cover(t)
+
+	return true
+}
+
+func (b *recordBuilder) log(l *logspb.LogRecord) bool {
+	template := ""
+	parameters := []string{}
+
+	for _, kv := range l.Attributes {
+		switch kv.Key {
+		case OTLPTemplateAttribute:
+			template = anyString(kv.Value)
+
+		case OTLPParametersAttribute:
+			for _, v := range kv.Value.GetArrayValue().GetValues() {
+				parameters = append(parameters, anyString(v))
+			}
+		}
+	}
+
+	if template == "" {
+		body := anyString(l.Body)
+		if body == "" {
+			return false
+		}
+
+		template = OTLPLogTemplate
+		parameters = []string{body}
+	}
+
+	t := l.TimeUnixNano
+	if t == 0 {
+		t = l.ObservedTimeUnixNano
+	}
+
+	if t == 0 {
+		t = uint64(time.Now().UnixNano())
+	}
+
+	b.cover(t)
+	b.logs = append(b.logs, &logsEntry{
+		template: template,
+		time:     t,
+		message: &pb.Message{
+			Parameters: parameters,
+			Level:      severityLevel(l.SeverityNumber),
+		},
+	})
+
+	return true
+}
+
+// record returns the record built, nil when it holds nothing.
+func (b *recordBuilder) record() *pb.Record {
+	r := b.r
+
+	for name, v := range b.numbers {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+
+		if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+			r.Numbers[name] = int64(v)
+		} else {
+			r.Instants[name] = v
+		}
+	}
+
+	if len(r.Numbers) == 0 && len(r.Instants) == 0 && len(b.logs) == 0 {
+		return nil
+	}
+
+	if b.start == 0 {
+		b.cover(uint64(time.Now().UnixNano()))
+	}
+
+	for _, e := range b.logs {
+		e.message.Offset = int64(e.time - b.start)
+
+		if _, ok := r.Logs[e.template]; !ok {
+			r.Logs[e.template] = &pb.Logs{}
+		}
+
+		r.Logs[e.template].Logs = append(r.Logs[e.template].Logs, e.message)
+	}
+
+	r.Start, _ = ptypes.TimestampProto(time.Unix(0, int64(b.start)))
+	r.End, _ = ptypes.TimestampProto(time.Unix(0, int64(b.end)))
+	r.Ts = r.Start
+
+	return r
+}
+
+// cumulative turns the points of cumulative sums into increases, per
+// session and series. A series seen for the first time, or restarted, has
+// increased by its whole value.
+type cumulative struct {
+	mu     sync.Mutex
+	series map[string]*cumulativePoint
+	pruned time.Time
+}
+
+type cumulativePoint struct {
+	start uint64
+	time  uint64
+	value float64
+	seen  time.Time
+}
+
+func newCumulative() *cumulative {
+	return &cumulative{
+		series: map[string]*cumulativePoint{},
+		pruned: time.Now(),
+	}
+}
+
+// delta returns the increase of the series up to the point at t, and the
+// time of the previous point it is the increase since, zero when unknown.
+func (c *cumulative) delta(session, name string, start, t uint64, value float64) (float64, uint64) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	now := time.Now()
+	key := session + "\x00" + name
+
+	// Series of the agents gone are forgotten as the agents are.
+	if now.Sub(c.pruned) > sessionTTL {
+		for k, p := range c.series {
+			if now.Sub(p.seen) > sessionTTL {
+				delete(c.series, k)
+			}
+		}
+
+		c.pruned = now
+	}
+
+	p, ok := c.series[key]
+	if !ok {
+		c.series[key] = &cumulativePoint{
+			start: start,
+			time:  t,
+			value: value,
+			seen:  now,
+		}
+
+		return value, 0
+	}
+
+	delta := value - p.value
+	since := p.time
+	if start != p.start || delta < 0 {
+		delta = value
+		since = 0
+	}
+
+	p.start = start
+	p.time = t
+	p.value = value
+	p.seen = now
+
+	return delta, since
+}
+
+// resourceSession names the session of the data of r.
+func resourceSession(r *resourcepb.Resource) string {
+	session := OTLPSession
+
+	for _, kv := range r.GetAttributes() {
+		switch kv.Key {
+		case "service.instance.id":
+			return anyString(kv.Value)
+
+		case "service.name":
+			session = anyString(kv.Value)
+		}
+	}
+
+	return session
+}
+
+// tags returns the attributes as gel tags, sorted by key so the same
+// attributes always make the same series.
+func tags(attributes []*commonpb.KeyValue) []string {
+	sorted := make([]*commonpb.KeyValue, len(attributes))
+	copy(sorted, attributes)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	t := make([]string, 0, 2*len(sorted))
+	for _, kv := range sorted {
+		t = append(t, kv.Key, anyString(kv.Value))
+	}
+
+	return t
+}
+
+func numberValue(p *metricspb.NumberDataPoint) float64 {
+	if v, ok := p.Value.(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+
+	return p.GetAsDouble()
+}
+
+func anyString(v *commonpb.AnyValue) string {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return fmt.Sprintf("%x", v.BytesValue)
+	case nil:
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+// severityLevel maps the severity ranges of OpenTelemetry to gel levels,
+// trace joining debug.
+func severityLevel(s logspb.SeverityNumber) pb.Level {
+	switch {
+	case s == logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED:
+		return pb.Level_INFO
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return pb.Level_DEBUG
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return pb.Level_INFO
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return pb.Level_WARN
+	case s < logspb.SeverityNumber_SEVERITY_NUMBER_FATAL:
+		return pb.Level_ERROR
+	}
+
+	return pb.Level_FATAL
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// otlpReceiver serves the OTLP services of a new server on a local port.
+func otlpReceiver(t *testing.T) (*GelServer, *grpc.ClientConn) {
+	gs, err := NewGelServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer()
+	gs.RegisterOTLP(s)
+
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return gs, conn
+}
+
+func exportMetrics(t *testing.T, conn *grpc.ClientConn, metrics ...*metricspb.Metric) {
+	_, err := colmetricspb.NewMetricsServiceClient(conn).Export(context.Background(), &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{
+			{
+				Resource: &resourcepb.Resource{
+					Attributes: []*commonpb.KeyValue{
+						{Key: "service.instance.id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "api-1"}}},
+					},
+				},
+				ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lastHour returns the series of the last hour named name, by type.
+func lastHour(t *testing.T, gs *GelServer, name string) map[string]*pb.Series {
+	from, _ := ptypes.TimestampProto(time.Now().Add(-time.Hour))
+
+	res, err := gs.Query(context.Background(), &pb.QueryRequest{
+		Name: name,
+		From: from,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := map[string]*pb.Series{}
+	for _, s := range res.Series {
+		series[s.Type] = s
+	}
+
+	return series
+}
+
+func nanos(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+func TestOTLPCumulativeStart(t *testing.T) {
+	gs, conn := otlpReceiver(t)
+
+	now := time.Now()
+	start := nanos(now.Add(-3 * time.Hour))
+
+	cumulative := func(v int64, at time.Time) *metricspb.Metric {
+		return &metricspb.Metric{
+			Name: "requests",
+			Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+				DataPoints: []*metricspb.NumberDataPoint{
+					{StartTimeUnixNano: start, TimeUnixNano: nanos(at), Value: &metricspb.NumberDataPoint_AsInt{AsInt: v}},
+				},
+			}},
+		}
+	}
+
+	delta := &metricspb.Metric{
+		Name: "errors",
+		Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints: []*metricspb.NumberDataPoint{
+				{StartTimeUnixNano: nanos(now.Add(-20 * time.Second)), TimeUnixNano: nanos(now.Add(-10 * time.Second)), Value: &metricspb.NumberDataPoint_AsInt{AsInt: 2}},
+			},
+		}},
+	}
+
+	exportMetrics(t, conn, cumulative(10, now.Add(-10*time.Second)), delta)
+	exportMetrics(t, conn, cumulative(15, now))
+
+	requests := lastHour(t, gs, "requests")[numberType]
+	if requests == nil {
+		t.Fatal("requests of the last hour missing")
+	}
+
+	sum := 0.0
+	for _, p := range requests.Points {
+		sum += p.Sum
+	}
+
+	if sum != 15 {
+		t.Errorf("requests summed to %v, want 15", sum)
+	}
+
+	if lastHour(t, gs, "errors")[numberType] == nil {
+		t.Error("errors of the last hour missing, filed at the start of the cumulative series")
+	}
+}
+
+func TestOTLPFractionalSums(t *testing.T) {
+	gs, conn := otlpReceiver(t)
+
+	now := time.Now()
+	start := nanos(now.Add(-10 * time.Second))
+	sum := 1.5
+
+	exportMetrics(t, conn,
+		&metricspb.Metric{
+			Name: "cpu.seconds",
+			Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints: []*metricspb.NumberDataPoint{
+					{StartTimeUnixNano: start, TimeUnixNano: nanos(now), Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 0.3}},
+				},
+			}},
+		},
+		&metricspb.Metric{
+			Name: "latency",
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints: []*metricspb.HistogramDataPoint{
+					{StartTimeUnixNano: start, TimeUnixNano: nanos(now), Count: 2, Sum: &sum, BucketCounts: []uint64{2}},
+				},
+			}},
+		},
+	)
+
+	cases := []struct {
+		name string
+		typ  string
+		want float64
+	}{
+		{"cpu.seconds", instantType, 0.3},
+		{"latency.sum", instantType, 1.5},
+		{"latency.count", numberType, 2},
+	}
+
+	for _, c := range cases {
+		s := lastHour(t, gs, c.name)[c.typ]
+		if s == nil || len(s.Points) != 1 {
+			t.Errorf("%s: %s series missing", c.name, c.typ)
+			continue
+		}
+
+		if got := s.Points[0].Last; got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOTLPLogBody(t *testing.T) {
+	gs, conn := otlpReceiver(t)
+
+	_, err := collogspb.NewLogsServiceClient(conn).Export(context.Background(), &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{
+			{
+				ScopeLogs: []*logspb.ScopeLogs{
+					{
+						LogRecords: []*logspb.LogRecord{
+							{TimeUnixNano: nanos(time.Now()), Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "user 1 logged in"}}},
+							{TimeUnixNano: nanos(time.Now()), Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "user 2 logged in"}}},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := lastHour(t, gs, "*")[logType]
+	if s == nil || s.Name != OTLPLogTemplate {
+		t.Fatalf("log series %v, want the %q template", s, OTLPLogTemplate)
+	}
+
+	if s.Points[0].Sum != 2 {
+		t.Errorf("%v messages, want 2", s.Points[0].Sum)
+	}
+}
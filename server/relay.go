@@ -0,0 +1,355 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	gelagent "github.com/duanckham/gel/agent"
+	"github.com/duanckham/gel/pb"
+)
+
+const (
+	relayBatch      = 100
+	relayTimeout    = 30 * time.Second
+	relayMinBackoff = time.Second
+	relayMaxBackoff = time.Minute
+)
+
+// relaySeqFile keeps the sequence number of the last aggregate in the data
+// directory.
+const relaySeqFile = "relay.seq"
+
+type relayOptions struct {
+	upstream   string
+	aggregate  time.Duration
+	session    string
+	spoolLimit int
+	agent      []gelagent.Option
+}
+
+// RelayOption configures the relay mode, see WithRelay.
+type RelayOption func(*relayOptions)
+
+// WithAggregation forwards, in place of the records of the agents, a
+// single record per window merging them all: numbers are summed and logs
+// are put together. Instants are not aggregated, the last value received
+// from any agent wins, so agents gauging the same name overwrite each other
+// and should tag it with their identity. Aggregated records belong to the
+// session of the relay, see WithRelaySession.
+func WithAggregation(window time.Duration) RelayOption {
+	return func(o *relayOptions) {
+		o.aggregate = window
+	}
+}
+
+// WithRelaySession names the session of the aggregated records, "relay-"
+// followed by the host name by default.
+func WithRelaySession(session string) RelayOption {
+	return func(o *relayOptions) {
+		o.session = session
+	}
+}
+
+// WithSpoolLimit bounds the records kept while the upstream server is
+// unreachable, DefaultSpoolLimit by default, the oldest are dropped first.
+func WithSpoolLimit(records int) RelayOption {
+	return func(o *relayOptions) {
+		o.spoolLimit = records
+	}
+}
+
+// WithUpstreamOptions configures the connection to the upstream server,
+// with agent.WithToken or agent.WithCompression.
+func WithUpstreamOptions(opts ...gelagent.Option) RelayOption {
+	return func(o *relayOptions) {
+		o.agent = append(o.agent, opts...)
+	}
+}
+
+// relay spools the records accepted, or their aggregates, and forwards
+// them upstream until it accepts them.
+type relay struct {
+	opts      *relayOptions
+	spool     *spool
+	forwarder *gelagent.Forwarder
+	wake      chan struct{}
+
+	mu        sync.Mutex
+	window    time.Time
+	aggregate *pb.Record
+
+	seqPath string
+	seq     uint64
+}
+
+func newRelay(dataDir string, o *relayOptions) (*relay, error) {
+	if dataDir == "" {
+		return nil, fmt.Errorf("relay needs a data directory to spool records")
+	}
+
+	host, portText, err := net.SplitHostPort(o.upstream)
+	if err != nil {
+		return nil, fmt.Errorf("relay upstream: %v", err)
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("relay upstream port: %v", err)
+	}
+
+	if o.session == "" {
+		hostname, _ := os.Hostname()
+		o.session = "relay-" + hostname
+	}
+
+	sp, err := newSpool(filepath.Join(dataDir, spoolDir), o.spoolLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &relay{
+		opts:      o,
+		spool:     sp,
+		forwarder: gelagent.NewForwarder(host, int32(port), o.agent...),
+		wake:      make(chan struct{}, 1),
+	}
+
+	if o.aggregate > 0 {
+		rl.seqPath = filepath.Join(dataDir, relaySeqFile)
+
+		if b, err := ioutil.ReadFile(rl.seqPath); err == nil {
+			if rl.seq, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+				return nil, fmt.Errorf("relay sequence: %v", err)
+			}
+		} else if os.IsNotExist(err) {
+			// Past the numbers of the windows since the epoch, which the
+			// aggregates of earlier relays had.
+			rl.seq = uint64(time.Now().UnixNano() / int64(o.aggregate))
+		} else {
+			return nil, err
+		}
+
+		rl.window = time.Now().Truncate(o.aggregate)
+		go rl.aggregateLoop()
+	}
+
+	go rl.forwardLoop()
+
+	return rl, nil
+}
+
+// add spools in, or merges it into the current aggregate. The address of
+// the agent is kept in the record, unless a relay before did.
+func (rl *relay) add(ctx context.Context, in *pb.Record) {
+	if rl.opts.aggregate > 0 {
+		rl.merge(in)
+		return
+	}
+
+	r := proto.Clone(in).(*pb.Record)
+
+	if p, ok := peer.FromContext(ctx); ok && r.Address == "" {
+		r.Address = p.Addr.String()
+	}
+
+	rl.push(r)
+}
+
+func (rl *relay) push(r *pb.Record) {
+	if err := rl.spool.push(r); err != nil {
+		fmt.Println("* gel relay spool err:", err)
+		return
+	}
+
+	select {
+	case rl.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (rl *relay) merge(in *pb.Record) {
+	defer rl.mu.Unlock()
+	rl.mu.Lock()
+
+	if rl.aggregate == nil {
+		rl.aggregate = &pb.Record{
+			Numbers:  map[string]int64{},
+			Instants: map[string]float64{},
+			Logs:     map[string]*pb.Logs{},
+		}
+	}
+
+	a := rl.aggregate
+
+	for k, v := range in.Numbers {
+		a.Numbers[k] += v
+	}
+
+	// The last agent wins, see WithAggregation.
+	for k, v := range in.Instants {
+		a.Instants[k] = v
+	}
+
+	// Offsets are relative to the start of the record, the window for the
+	// aggregate.
+	start, _ := ptypes.Timestamp(in.Start)
+	shift := int64(start.Sub(rl.window))
+
+	for template, logs := range in.Logs {
+		l, ok := a.Logs[template]
+		if !ok {
+			l = &pb.Logs{}
+			a.Logs[template] = l
+		}
+
+		for _, m := range logs.Logs {
+			offset := m.Offset + shift
+			if offset < 0 {
+				offset = 0
+			}
+
+			l.Logs = append(l.Logs, &pb.Message{
+				Parameters: m.Parameters,
+				Offset:     offset,
+				Level:      m.Level,
+			})
+		}
+
+		l.Suppressed += logs.Suppressed
+	}
+}
+
+// aggregateLoop spools the aggregate at the end of every window, windows
+// being aligned on the wall clock and the ones without records skipped.
+// Aggregates are numbered one after the other, the last number being kept
+// in the data directory so that it goes on after a restart.
+func (rl *relay) aggregateLoop() {
+	w := rl.opts.aggregate
+
+	for {
+		rl.mu.Lock()
+		end := rl.window.Add(w)
+		rl.mu.Unlock()
+
+		time.Sleep(time.Until(end))
+
+		rl.mu.Lock()
+		a := rl.aggregate
+		start := rl.window
+		rl.aggregate = nil
+		rl.window = time.Now().Truncate(w)
+		rl.mu.Unlock()
+
+		if a == nil {
+			continue
+		}
+
+		a.Session = rl.opts.session
+		a.Seq = rl.nextSeq()
+		a.Start, _ = ptypes.TimestampProto(start)
+		a.End, _ = ptypes.TimestampProto(start.Add(w))
+		a.Ts = a.Start
+
+		rl.push(a)
+	}
+}
+
+// nextSeq returns the sequence number of the next aggregate and persists
+// it, only the aggregate loop calls it.
+func (rl *relay) nextSeq() uint64 {
+	rl.seq++
+
+	tmp := rl.seqPath + ".tmp"
+
+	err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(rl.seq, 10)), 0644)
+	if err == nil {
+		err = os.Rename(tmp, rl.seqPath)
+	}
+
+	if err != nil {
+		fmt.Println("* gel relay sequence err:", err)
+	}
+
+	return rl.seq
+}
+
+// forwardLoop sends the spooled records upstream, oldest first, backing off
+// while the upstream server fails. A batch the upstream server refuses as
+// invalid is sent again record by record, and only the records it refuses
+// are dropped, sending them again would not help.
+func (rl *relay) forwardLoop() {
+	backoff := relayMinBackoff
+
+	for {
+		names, records := rl.spool.peek(relayBatch)
+		if len(records) == 0 {
+			<-rl.wake
+			continue
+		}
+
+		err := rl.forward(records)
+		if status.Code(err) == codes.InvalidArgument && len(records) > 1 {
+			err = rl.forwardEach(names, records)
+		}
+
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			fmt.Println("* gel relay forward err:", err)
+
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > relayMaxBackoff {
+				backoff = relayMaxBackoff
+			}
+
+			continue
+		}
+
+		if err != nil {
+			fmt.Println("* gel relay records dropped:", len(records), err)
+		}
+
+		backoff = relayMinBackoff
+		rl.spool.remove(names)
+	}
+}
+
+func (rl *relay) forward(records []*pb.Record) error {
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+
+	return rl.forwarder.Forward(ctx, records)
+}
+
+// forwardEach sends records one at a time, removing each from the spool
+// once accepted or refused as invalid. It stops at the first other error.
+func (rl *relay) forwardEach(names []string, records []*pb.Record) error {
+	for i, r := range records {
+		err := rl.forward([]*pb.Record{r})
+		if err != nil && status.Code(err) != codes.InvalidArgument {
+			return err
+		}
+
+		if err != nil {
+			fmt.Println("* gel relay record dropped:", r.Session, r.Seq, err)
+		}
+
+		rl.spool.remove(names[i : i+1])
+	}
+
+	return nil
+}
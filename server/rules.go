@@ -0,0 +1,407 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RuleKind is the condition a rule checks.
+type RuleKind string
+
+// Rule kinds.
+const (
+	// ThresholdRule compares the series reduced over the window with Value.
+	ThresholdRule RuleKind = "threshold"
+	// RateRule compares the relative change of the series reduced over the
+	// window from the window before with Value, 1 means it doubled.
+	RateRule RuleKind = "rate"
+	// AbsenceRule fires for an agent session whose series got no point for
+	// the window. The sessions a restart replaced, followed by a new one from
+	// the same host, and the ones the agents registry forgot are left out.
+	AbsenceRule RuleKind = "absence"
+)
+
+// Reducers of the points of a window.
+const (
+	ReduceSum  = "sum"
+	ReduceAvg  = "avg"
+	ReduceMin  = "min"
+	ReduceMax  = "max"
+	ReduceLast = "last"
+)
+
+// DefaultRuleInterval is how often rules are evaluated.
+const DefaultRuleInterval = 30 * time.Second
+
+// Rule is an alerting condition over the stored series, evaluated for
+// every series and agent session it matches.
+type Rule struct {
+	Name string
+	Kind RuleKind
+	// Series is a glob pattern of the series names, log templates included,
+	// all of them when empty.
+	Series string
+	// Agent restricts the rule to an agent session.
+	Agent  string
+	Window time.Duration
+	// Reduce is one of the reducers, it defaults to ReduceSum for numbers
+	// and log counts, to ReduceLast for instants.
+	Reduce string
+	// Op is one of >, >=, <, <=, == and !=, unused by AbsenceRule.
+	Op    string
+	Value float64
+	// For is how long the condition holds before the alert fires.
+	For time.Duration
+	// Repeat notifies a firing alert again, only once when zero.
+	Repeat time.Duration
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without a name")
+	}
+
+	if r.Window <= 0 {
+		return fmt.Errorf("rule %q: no window", r.Name)
+	}
+
+	switch r.Reduce {
+	case "", ReduceSum, ReduceAvg, ReduceMin, ReduceMax, ReduceLast:
+	default:
+		return fmt.Errorf("rule %q: unknown reducer %q", r.Name, r.Reduce)
+	}
+
+	switch r.Kind {
+	case ThresholdRule, RateRule:
+		if _, ok := compare(r.Op, 0, 0); !ok {
+			return fmt.Errorf("rule %q: unknown operator %q", r.Name, r.Op)
+		}
+
+	case AbsenceRule:
+
+	default:
+		return fmt.Errorf("rule %q: unknown kind %q", r.Name, r.Kind)
+	}
+
+	return nil
+}
+
+func compare(op string, a, b float64) (result bool, ok bool) {
+	switch op {
+	case ">":
+		return a > b, true
+	case ">=":
+		return a >= b, true
+	case "<":
+		return a < b, true
+	case "<=":
+		return a <= b, true
+	case "==":
+		return a == b, true
+	case "!=":
+		return a != b, true
+	}
+
+	return false, false
+}
+
+// reduce returns the value of the points of a series of type typ. Windows
+// without points are worth 0 for the sum and NaN otherwise.
+func reduce(reducer, typ string, points []point) float64 {
+	if reducer == "" {
+		reducer = ReduceSum
+		if typ == instantType {
+			reducer = ReduceLast
+		}
+	}
+
+	if reducer == ReduceSum {
+		sum := 0.0
+		for _, p := range points {
+			sum += p.Sum
+		}
+
+		return sum
+	}
+
+	if len(points) == 0 {
+		return math.NaN()
+	}
+
+	v := points[0]
+	for _, p := range points[1:] {
+		v.merge(p)
+	}
+
+	switch reducer {
+	case ReduceAvg:
+		return v.Sum / float64(v.Count)
+	case ReduceMin:
+		return v.Min
+	case ReduceMax:
+		return v.Max
+	}
+
+	return v.Last
+}
+
+// AlertState is the state of an alert.
+type AlertState string
+
+// Alert states, an alert is notified when it fires and when it resolves.
+const (
+	AlertPending  AlertState = "pending"
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// Alert is a rule whose condition holds for a series of an agent session.
+type Alert struct {
+	Rule   string     `json:"rule"`
+	Series string     `json:"series"`
+	Agent  string     `json:"agent"`
+	State  AlertState `json:"state"`
+	Value  float64    `json:"value"`
+	Since  time.Time  `json:"since"`
+	At     time.Time  `json:"at"`
+
+	notified time.Time
+}
+
+// MarshalJSON encodes an infinite value, the rate of a series rising from
+// 0, as null.
+func (a Alert) MarshalJSON() ([]byte, error) {
+	type alert Alert
+
+	v := struct {
+		alert
+		Value *float64 `json:"value"`
+	}{
+		alert: alert(a),
+	}
+
+	if !math.IsInf(a.Value, 0) && !math.IsNaN(a.Value) {
+		v.Value = &a.Value
+	}
+
+	return json.Marshal(v)
+}
+
+type alertKey struct {
+	rule   string
+	series string
+	agent  string
+}
+
+// Notifier delivers alerts.
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// NotifierFunc adapts a function to a Notifier.
+type NotifierFunc func(alert Alert) error
+
+// Notify calls f.
+func (f NotifierFunc) Notify(alert Alert) error {
+	return f(alert)
+}
+
+// rules evaluates the rules over the store and notifies the alerts changing
+// state, at most once per transition.
+type rules struct {
+	mu        sync.Mutex
+	store     *store
+	agents    *agents
+	rules     []Rule
+	notifiers []Notifier
+	alerts    map[alertKey]*Alert
+}
+
+func newRules(st *store, as *agents, rs []Rule, notifiers []Notifier, interval time.Duration) (*rules, error) {
+	names := map[string]bool{}
+
+	for _, r := range rs {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %q defined twice", r.Name)
+		}
+
+		names[r.Name] = true
+	}
+
+	if len(notifiers) == 0 {
+		notifiers = []Notifier{NotifierFunc(printAlert)}
+	}
+
+	e := &rules{
+		store:     st,
+		agents:    as,
+		rules:     rs,
+		notifiers: notifiers,
+		alerts:    map[alertKey]*Alert{},
+	}
+
+	if len(rs) > 0 {
+		go e.run(interval)
+	}
+
+	return e, nil
+}
+
+func (e *rules) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for now := range t.C {
+		e.evaluate(now)
+	}
+}
+
+// evaluate moves the alerts of every rule through their states and notifies
+// the transitions.
+func (e *rules) evaluate(now time.Time) {
+	notify := []Alert{}
+
+	e.mu.Lock()
+
+	for _, r := range e.rules {
+		active := e.check(r, now)
+
+		for key, a := range e.alerts {
+			if key.rule != r.Name {
+				continue
+			}
+
+			if _, ok := active[key]; ok {
+				continue
+			}
+
+			delete(e.alerts, key)
+
+			if a.State == AlertFiring {
+				a.State = AlertResolved
+				a.At = now
+				notify = append(notify, *a)
+			}
+		}
+
+		for key, value := range active {
+			a, ok := e.alerts[key]
+			if !ok {
+				a = &Alert{
+					Rule:   key.rule,
+					Series: key.series,
+					Agent:  key.agent,
+					State:  AlertPending,
+					Since:  now,
+				}
+
+				e.alerts[key] = a
+			}
+
+			a.Value = value
+			a.At = now
+
+			switch {
+			case a.State == AlertPending && now.Sub(a.Since) >= r.For:
+				a.State = AlertFiring
+				a.notified = now
+				notify = append(notify, *a)
+
+			case a.State == AlertFiring && r.Repeat > 0 && now.Sub(a.notified) >= r.Repeat:
+				a.notified = now
+				notify = append(notify, *a)
+			}
+		}
+	}
+
+	e.mu.Unlock()
+
+	for _, a := range notify {
+		for _, n := range e.notifiers {
+			if err := n.Notify(a); err != nil {
+				fmt.Println("* notify err:", a.Rule, err)
+			}
+		}
+	}
+}
+
+// check returns the value of every series for which the condition of r
+// holds.
+func (e *rules) check(r Rule, now time.Time) map[alertKey]float64 {
+	pattern := r.Series
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	from := now.Add(-r.Window)
+	switch r.Kind {
+	case RateRule:
+		from = now.Add(-2 * r.Window)
+	case AbsenceRule:
+		from = now.Add(-sessionTTL)
+	}
+
+	_, result := e.store.query(pattern, r.Agent, from, now)
+
+	active := map[alertKey]float64{}
+
+	if r.Kind == AbsenceRule {
+		restarted := e.agents.restarts()
+
+		last := map[string]time.Time{}
+		for _, se := range result {
+			if replaced, ok := restarted[se.Agent]; !ok || replaced {
+				continue
+			}
+
+			points := se.tiers[0]
+			if t := points[len(points)-1].Time; t.After(last[se.Agent]) {
+				last[se.Agent] = t
+			}
+		}
+
+		for agent, t := range last {
+			if silent := now.Sub(t); silent >= r.Window {
+				active[alertKey{r.Name, r.Series, agent}] = silent.Seconds()
+			}
+		}
+
+		return active
+	}
+
+	for _, se := range result {
+		points := se.tiers[0]
+		value := reduce(r.Reduce, se.Type, between(points, now.Add(-r.Window), now))
+
+		if r.Kind == RateRule {
+			previous := reduce(r.Reduce, se.Type, between(points, from, now.Add(-r.Window)))
+
+			switch {
+			case previous != 0:
+				value = (value - previous) / math.Abs(previous)
+			case value > 0:
+				value = math.Inf(1)
+			case value < 0:
+				value = math.Inf(-1)
+			}
+		}
+
+		if ok, _ := compare(r.Op, value, r.Value); ok {
+			active[alertKey{r.Name, se.Name, se.Agent}] = value
+		}
+	}
+
+	return active
+}
+
+func printAlert(a Alert) error {
+	fmt.Println("* (alert)", a.State, a.Rule, a.Series, a.Agent, "value:", a.Value, "since:", a.Since)
+	return nil
+}
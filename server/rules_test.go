@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/peer"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// deliver stores a record of session sent from addr at t.
+func deliver(st *store, as *agents, session, addr string, t time.Time) {
+	start, _ := ptypes.TimestampProto(t)
+
+	r := &pb.Record{
+		Session: session,
+		Start:   start,
+		Numbers: map[string]int64{"requests": 1},
+	}
+
+	_, known := as.sessions[session]
+
+	tcp, _ := net.ResolveTCPAddr("tcp", addr)
+	as.seen(peer.NewContext(context.Background(), &peer.Peer{Addr: tcp}), r)
+
+	if !known {
+		as.sessions[session].firstSeen = t
+	}
+
+	as.sessions[session].lastSeen = t
+
+	st.add(r)
+}
+
+func absence(t *testing.T) (*store, *agents, *rules) {
+	st, err := newStore(DefaultTiers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as := newAgents()
+
+	e, err := newRules(st, as, nil, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return st, as, e
+}
+
+func absent(e *rules, now time.Time) map[string]bool {
+	agents := map[string]bool{}
+
+	for key := range e.check(Rule{Name: "up", Kind: AbsenceRule, Series: "requests", Window: time.Minute}, now) {
+		agents[key.agent] = true
+	}
+
+	return agents
+}
+
+func TestAbsenceSharedHost(t *testing.T) {
+	st, as, e := absence(t)
+	now := time.Now()
+
+	deliver(st, as, "api", "127.0.0.1:5001", now.Add(-10*time.Minute))
+	deliver(st, as, "sidecar", "127.0.0.1:5002", now.Add(-11*time.Minute))
+	deliver(st, as, "sidecar", "127.0.0.1:5002", now.Add(-10*time.Second))
+
+	if got := absent(e, now); len(got) != 1 || !got["api"] {
+		t.Errorf("absent %v, want api only", got)
+	}
+}
+
+func TestAbsenceRestart(t *testing.T) {
+	st, as, e := absence(t)
+	now := time.Now()
+
+	deliver(st, as, "api-1", "10.0.0.1:5001", now.Add(-10*time.Minute))
+	deliver(st, as, "api-2", "10.0.0.1:5002", now.Add(-5*time.Minute))
+
+	if got := absent(e, now); len(got) != 1 || !got["api-2"] {
+		t.Errorf("absent %v, want the session after the restart only", got)
+	}
+}
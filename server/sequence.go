@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultDedupeWindow is how many sequence numbers of a session are
+// remembered, to tell a duplicate from a late arrival.
+const DefaultDedupeWindow = 1024
+
+const sequencesFile = "sequences.jsonl"
+
+// sessionTTL is how long a silent session is tracked.
+const sessionTTL = 24 * time.Hour
+
+// arrival classifies a record by its sequence number.
+type arrival int
+
+const (
+	inOrder arrival = iota
+	// gap: records between the last one and this one are missing.
+	gap
+	// duplicate: the record was already received.
+	duplicate
+	// outOfOrder: the record fills an earlier gap.
+	outOfOrder
+)
+
+func (a arrival) String() string {
+	switch a {
+	case gap:
+		return "gap"
+	case duplicate:
+		return "duplicate"
+	case outOfOrder:
+		return "out of order"
+	}
+
+	return "in order"
+}
+
+type sequence struct {
+	last     uint64
+	seen     map[uint64]bool
+	lastSeen time.Time
+}
+
+type accepted struct {
+	Session string `json:"session"`
+	Seq     uint64 `json:"seq"`
+}
+
+// sequences tracks the sequence numbers of every session. Accepted ones are
+// appended to a file in the data directory and read back on start, so a
+// record delivered again after a server restart is still known.
+type sequences struct {
+	mu        sync.Mutex
+	window    uint64
+	sessions  map[string]*sequence
+	lastPrune time.Time
+	journal   *journal
+}
+
+func newSequences(dir string, window uint64) (*sequences, error) {
+	if window < 1 {
+		window = 1
+	}
+
+	s := &sequences{
+		window:    window,
+		sessions:  map[string]*sequence{},
+		lastPrune: time.Now(),
+	}
+
+	if dir == "" {
+		return s, nil
+	}
+
+	j, err := openJournal(filepath.Join(dir, sequencesFile), func(line []byte) error {
+		a := accepted{}
+		if err := json.Unmarshal(line, &a); err != nil {
+			return err
+		}
+
+		if _, _, ok := s.classify(a.Session, a.Seq); ok {
+			s.mark(a.Session, a.Seq)
+		}
+
+		return nil
+	}, s.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	s.journal = j
+
+	return s, nil
+}
+
+// observe records seq for session unless it is a duplicate, missing is the
+// number of records skipped over by a gap. The record must not be ingested
+// when err is not nil, it is not remembered.
+func (s *sequences) observe(session string, seq uint64) (a arrival, missing uint64, err error) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	s.prune(time.Now())
+
+	a, missing, ok := s.classify(session, seq)
+	if !ok {
+		return a, 0, nil
+	}
+
+	if err := s.journal.append(accepted{Session: session, Seq: seq}); err != nil {
+		return a, missing, err
+	}
+
+	s.mark(session, seq)
+
+	return a, missing, nil
+}
+
+// classify tells how seq arrives for session, ok is false for a duplicate.
+func (s *sequences) classify(session string, seq uint64) (a arrival, missing uint64, ok bool) {
+	q, known := s.sessions[session]
+
+	switch {
+	case !known:
+		return inOrder, 0, true
+
+	case q.seen[seq]:
+		return duplicate, 0, false
+
+	case seq <= q.last && q.last-seq >= s.window:
+		// Too old to know, most likely a duplicate.
+		return duplicate, 0, false
+
+	case seq <= q.last:
+		return outOfOrder, 0, true
+
+	case seq > q.last+1:
+		return gap, seq - q.last - 1, true
+	}
+
+	return inOrder, 0, true
+}
+
+func (s *sequences) mark(session string, seq uint64) {
+	q, ok := s.sessions[session]
+	if !ok {
+		q = &sequence{
+			seen: map[uint64]bool{},
+		}
+
+		s.sessions[session] = q
+	}
+
+	q.lastSeen = time.Now()
+	q.seen[seq] = true
+
+	if seq > q.last {
+		q.last = seq
+	}
+
+	for n := range q.seen {
+		if q.last-n >= s.window {
+			delete(q.seen, n)
+		}
+	}
+}
+
+// entries writes the numbers still in the window of every session.
+func (s *sequences) entries(write func(v interface{})) {
+	for session, q := range s.sessions {
+		for seq := range q.seen {
+			write(accepted{
+				Session: session,
+				Seq:     seq,
+			})
+		}
+	}
+}
+
+func (s *sequences) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+
+	s.lastPrune = now
+
+	for session, q := range s.sessions {
+		if now.Sub(q.lastSeen) > sessionTTL {
+			delete(s.sessions, session)
+		}
+	}
+}
+
+func printArrival(session string, seq uint64, a arrival, missing uint64) {
+	switch a {
+	case gap:
+		fmt.Println("* (sequence)", session, seq, a, "missing:", missing)
+
+	case duplicate, outOfOrder:
+		fmt.Println("* (sequence)", session, seq, a)
+	}
+}
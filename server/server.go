@@ -4,48 +4,439 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	_ "github.com/duanckham/gel/compressor"
 	"github.com/duanckham/gel/gel"
 	"github.com/duanckham/gel/pb"
-	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes"
 )
 
 // GelServer ...
-type GelServer struct{}
+type GelServer struct {
+	dictionary *dictionary
+	buckets    *buckets
+	sequences  *sequences
+	store      *store
+	rules      *rules
+	tails      *tails
+	agents     *agents
+	relay      *relay
+	recent     *recent
+	parameters *parameters
+	firstSeen  *firstSeen
+	tokens     map[string]bool
+
+	// percentiles of the instants across agents.
+	percentiles []float64
+}
 
 // New return a server.
-func New(port int32) {
+func New(port int32, opts ...Option) {
+	if err := Serve(port, opts...); err != nil {
+		// TODO
+		fmt.Println("* server.Serve err:", err)
+	}
+}
+
+// Serve runs the service on port, along with HTTPHandler when WithHTTPAddr
+// is given, until the gRPC server stops.
+func Serve(port int32, opts ...Option) error {
+	o := newOptions(opts)
+
+	gs, err := newGelServer(o)
+	if err != nil {
+		return err
+	}
+
 	s, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
-		// TODO
-		fmt.Println("* net.Listen err:", err)
+		return err
+	}
+
+	if o.httpAddr != "" {
+		l, err := net.Listen("tcp", o.httpAddr)
+		if err != nil {
+			return err
+		}
+
+		go serveHTTP(gs, l)
 	}
 
 	grpcServer := grpc.NewServer()
 
-	pb.RegisterGelServiceServer(grpcServer, &GelServer{})
+	pb.RegisterGelServiceServer(grpcServer, gs)
+	gs.RegisterOTLP(grpcServer)
+
+	fmt.Println("* gel server listening on", s.Addr())
+
+	return grpcServer.Serve(s)
+}
+
+// NewGelServer return the service, to register on a grpc.Server.
+func NewGelServer(opts ...Option) (*GelServer, error) {
+	return newGelServer(newOptions(opts))
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		bucketWidth: DefaultBucketWidth,
+		percentiles: DefaultPercentiles,
+		dedupe:      DefaultDedupeWindow,
+		tiers:       DefaultTiers,
+
+		ruleInterval: DefaultRuleInterval,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.grace == 0 {
+		o.grace = o.bucketWidth
+	}
+
+	return o
+}
+
+func newGelServer(o *options) (*GelServer, error) {
+	for _, p := range o.percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("percentile %v out of [0, 100]", p)
+		}
+	}
+
+	if o.dataDir != "" {
+		if err := os.MkdirAll(o.dataDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := newDictionary(o.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sq, err := newSequences(o.dataDir, o.dedupe)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := newStore(o.tiers)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := newFirstSeen(o.dataDir, st.tiers[len(st.tiers)-1].Retention)
+	if err != nil {
+		return nil, err
+	}
+
+	as := newAgents()
+
+	rs, err := newRules(st, as, o.rules, o.notifiers, o.ruleInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	var rl *relay
+	if o.relay != nil {
+		if rl, err = newRelay(o.dataDir, o.relay); err != nil {
+			return nil, err
+		}
+	}
 
-	grpcServer.Serve(s)
+	// Buckets closed are stored as the aggregates across agents.
+	bs := newBuckets(o.bucketWidth, o.grace, func(b *bucket) {
+		st.addBucket(b, o.percentiles)
+		printBucket(b)
+	})
+
+	var rc *recent
+	if o.dashboard {
+		rc = newRecent()
+	}
+
+	return &GelServer{
+		dictionary:  d,
+		buckets:     bs,
+		sequences:   sq,
+		store:       st,
+		rules:       rs,
+		tails:       newTails(),
+		agents:      as,
+		relay:       rl,
+		recent:      rc,
+		parameters:  newParameters(),
+		firstSeen:   fs,
+		tokens:      o.tokens,
+		percentiles: o.percentiles,
+	}, nil
 }
 
 // SyncRecord endpoint receive agent.
-func (gs *GelServer) SyncRecord(ctx context.Context, in *pb.Record) (*empty.Empty, error) {
+func (gs *GelServer) SyncRecord(ctx context.Context, in *pb.Record) (*pb.SyncResponse, error) {
+	if err := gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	return gs.sync(ctx, []*pb.Record{in})
+}
+
+// SyncRecords endpoint receive a batch of records from an agent.
+func (gs *GelServer) SyncRecords(ctx context.Context, in *pb.Records) (*pb.SyncResponse, error) {
+	if err := gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	return gs.sync(ctx, in.Records)
+}
+
+// sync ingests records, whichever way they came. Records are all validated
+// and resolved before any is ingested, records of a batch sent again after
+// an error are reported as duplicates.
+func (gs *GelServer) sync(ctx context.Context, records []*pb.Record) (*pb.SyncResponse, error) {
+	for _, r := range records {
+		if err := validate(r); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range records {
+		if err := gs.dictionary.resolve(r); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &pb.SyncResponse{
+		Statuses: make([]pb.SyncStatus, 0, len(records)),
+	}
+
+	for _, r := range records {
+		s, err := gs.ingest(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Statuses = append(res.Statuses, s)
+	}
+
+	return res, nil
+}
+
+// Query endpoint returns the stored series matching the request, from the
+// finest tier still holding its start. The aggregates across agents are
+// queried with the agent AggregateAgent.
+func (gs *GelServer) Query(ctx context.Context, in *pb.QueryRequest) (*pb.QueryResponse, error) {
+	if err := gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	from, err := ptypes.Timestamp(in.From)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "from: %v", err)
+	}
+
+	to := time.Now()
+	if in.To != nil {
+		if to, err = ptypes.Timestamp(in.To); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "to: %v", err)
+		}
+	}
+
+	tier, result := gs.store.query(in.Name, in.Agent, from, to)
+
+	res := &pb.QueryResponse{
+		Resolution: ptypes.DurationProto(tier.Resolution),
+	}
+
+	if in.Agent == AggregateAgent {
+		res.Percentiles = gs.percentiles
+	}
+
+	for _, se := range result {
+		res.Series = append(res.Series, seriesProto(se))
+	}
+
+	return res, nil
+}
+
+// Tail endpoint streams the units of the records ingested from now on that
+// match the request. Units are dropped for a client too slow to keep up.
+func (gs *GelServer) Tail(in *pb.TailRequest, stream pb.GelService_TailServer) error {
+	if err := gs.authorize(stream.Context()); err != nil {
+		return err
+	}
+
+	s := gs.tails.subscribe(in)
+	defer gs.tails.unsubscribe(s)
+
+	for {
+		select {
+		case u := <-s.units:
+			if err := stream.Send(u); err != nil {
+				return err
+			}
+
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Agents endpoint lists the agent sessions seen lately.
+func (gs *GelServer) Agents(ctx context.Context, in *pb.AgentsRequest) (*pb.AgentsResponse, error) {
+	if err := gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	return &pb.AgentsResponse{
+		Agents: gs.agents.list(),
+	}, nil
+}
+
+// Templates endpoint ranks the log templates by how fast their messages
+// grow over the window against the window before, and lists the templates
+// first seen in the window. First seen dates outlive a restart with a data
+// directory only, without one every template is new to a restarted server.
+func (gs *GelServer) Templates(ctx context.Context, in *pb.TemplatesRequest) (*pb.TemplatesResponse, error) {
+	if err := gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	window := DefaultTemplatesWindow
+	if in.Window != nil {
+		w, err := ptypes.Duration(in.Window)
+		if err != nil || w <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "window %v", in.Window)
+		}
+
+		window = w
+	}
+
+	limit := int(in.Limit)
+	if limit <= 0 {
+		limit = defaultTemplatesLimit
+	}
+
+	now := time.Now()
+	since := now.Add(-window)
+
+	counts := gs.store.logCounts(in.Agent, since.Add(-window), since, now)
+	gs.firstSeen.earliest(counts)
+
+	return rankTemplates(counts, since, limit), nil
+}
+
+// Parameters endpoint counts the values at every position of the parameters
+// of a template, over the messages received since the server started.
+func (gs *GelServer) Parameters(ctx context.Context, in *pb.ParametersRequest) (*pb.ParametersResponse, error) {
+	if err := gs.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	if in.Template == "" {
+		return nil, status.Error(codes.InvalidArgument, "template missing")
+	}
+
+	limit := int(in.Limit)
+	if limit <= 0 {
+		limit = defaultTemplatesLimit
+	}
+
+	res := gs.parameters.histogram(in.Template, limit)
+	if res == nil {
+		return nil, status.Errorf(codes.NotFound, "template %q not tracked", in.Template)
+	}
+
+	return res, nil
+}
+
+func seriesProto(se *series) *pb.Series {
+	s := &pb.Series{
+		Name:  se.Name,
+		Agent: se.Agent,
+		Type:  se.Type,
+	}
+
+	for _, p := range se.tiers[0] {
+		t, _ := ptypes.TimestampProto(p.Time)
+
+		s.Points = append(s.Points, &pb.Point{
+			Time:  t,
+			Count: p.Count,
+			Sum:   p.Sum,
+			Min:   p.Min,
+			Max:   p.Max,
+			Last:  p.Last,
+
+			Percentiles: p.Percentiles,
+		})
+	}
+
+	return s
+}
+
+// ingest counts in once per session and sequence number.
+func (gs *GelServer) ingest(ctx context.Context, in *pb.Record) (pb.SyncStatus, error) {
+	gs.agents.seen(ctx, in)
+
+	// Records of older agents have no sequence number.
+	if in.Seq > 0 {
+		a, missing, err := gs.sequences.observe(in.Session, in.Seq)
+		if err != nil {
+			return pb.SyncStatus_ACCEPTED, status.Errorf(codes.Internal, "persist sequence: %v", err)
+		}
+
+		printArrival(in.Session, in.Seq, a, missing)
+
+		if a == duplicate {
+			return pb.SyncStatus_DUPLICATE, nil
+		}
+	}
+
+	if gs.relay != nil {
+		gs.relay.add(ctx, in)
+	}
+
+	if gs.recent != nil {
+		gs.recent.add(in)
+	}
+
+	gs.parameters.add(in)
+	gs.firstSeen.add(in)
+
+	gs.buckets.add(in)
+	gs.store.add(in)
+
 	reader, done := gel.Read(in)
 	start := time.Now()
 
 	go func() {
 		for {
 			select {
-			case data := <-reader:
+			case data, ok := <-reader:
+				if !ok {
+					reader = nil
+					continue
+				}
+
+				gs.tails.publish(in.Session, data)
+
 				switch data.T {
 				case "log":
 					fmt.Println("* (log)", data.D, data.V)
 
 				case "number", "instant":
 					fmt.Println("* (number or instant)", data.T, data.D, data.V)
+
+				case "suppressed":
+					fmt.Println("* (suppressed)", data.D, data.K, data.V)
 				}
 			case <-done:
 				fmt.Println("* data all processed, cost:", time.Since(start))
@@ -54,5 +445,5 @@ func (gs *GelServer) SyncRecord(ctx context.Context, in *pb.Record) (*empty.Empt
 		}
 	}()
 
-	return &empty.Empty{}, nil
+	return pb.SyncStatus_ACCEPTED, nil
 }
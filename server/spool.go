@@ -0,0 +1,210 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// DefaultSpoolLimit is the number of records a relay keeps while its
+// upstream is unreachable.
+const DefaultSpoolLimit = 100000
+
+const (
+	spoolDir = "spool"
+	spoolExt = ".rec"
+)
+
+// spool keeps records on disk, one file each, until they are forwarded.
+// Records past the limit drop the oldest ones.
+type spool struct {
+	mu    sync.Mutex
+	dir   string
+	limit int
+	names []string
+	next  uint64
+}
+
+// newSpool opens dir, the records left by a previous process are kept.
+func newSpool(dir string, limit int) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:   dir,
+		limit: limit,
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolExt) {
+			continue
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.names = append(s.names, f.Name())
+
+		if n >= s.next {
+			s.next = n + 1
+		}
+	}
+
+	sort.Strings(s.names)
+
+	return s, nil
+}
+
+// push writes r to its own file, renamed into place once complete.
+func (s *spool) push(r *pb.Record) error {
+	b, err := proto.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	name := fmt.Sprintf("%020d%s", s.next, spoolExt)
+	path := filepath.Join(s.dir, name)
+
+	if err := writeSync(path+".tmp", b); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is synced.
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	s.next++
+	s.names = append(s.names, name)
+
+	if s.limit > 0 && len(s.names) > s.limit {
+		dropped := s.names[:len(s.names)-s.limit]
+		s.names = s.names[len(dropped):]
+
+		for _, name := range dropped {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+
+		fmt.Println("* gel spool full, records dropped:", len(dropped))
+	}
+
+	return nil
+}
+
+// writeSync writes b to the file at path and syncs it to the disk.
+func writeSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// peek reads the n oldest records, the unreadable ones are discarded.
+func (s *spool) peek(n int) ([]string, []*pb.Record) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	names := []string{}
+	records := []*pb.Record{}
+	broken := map[string]bool{}
+
+	for _, name := range s.names {
+		if len(records) == n {
+			break
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if err == nil {
+			r := &pb.Record{}
+			if err = proto.Unmarshal(b, r); err == nil {
+				names = append(names, name)
+				records = append(records, r)
+				continue
+			}
+		}
+
+		fmt.Println("* gel spool read err:", name, err)
+		broken[name] = true
+	}
+
+	if len(broken) > 0 {
+		s.removeLocked(broken)
+	}
+
+	return names, records
+}
+
+// remove discards the records of names, forwarded.
+func (s *spool) remove(names []string) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	set := map[string]bool{}
+	for _, name := range names {
+		set[name] = true
+	}
+
+	s.removeLocked(set)
+}
+
+func (s *spool) removeLocked(set map[string]bool) {
+	kept := s.names[:0]
+
+	for _, name := range s.names {
+		if set[name] {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+
+		kept = append(kept, name)
+	}
+
+	s.names = kept
+}
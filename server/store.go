@@ -0,0 +1,526 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// Tier is a resolution the store keeps the points of every series at, for
+// as long as its retention. A zero resolution keeps one point per record.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// DefaultTiers keep raw points for 2 days, 1 minute rollups for 30 days and
+// 1 hour rollups for a year.
+var DefaultTiers = []Tier{
+	{Resolution: 0, Retention: 48 * time.Hour},
+	{Resolution: time.Minute, Retention: 30 * 24 * time.Hour},
+	{Resolution: time.Hour, Retention: 365 * 24 * time.Hour},
+}
+
+// rollupDelay is how long the points of an interval are waited for before
+// it is rolled up. Points arriving later only show in the finer tiers.
+const rollupDelay = time.Minute
+
+// Types of series, the series of a log template counts its messages.
+const (
+	numberType  = "number"
+	instantType = "instant"
+	logType     = "log"
+)
+
+// AggregateAgent is the agent of the series aggregating every agent, see
+// store.addBucket.
+const AggregateAgent = "*"
+
+// point summarizes the values of a series over an interval. Counters are
+// read from Sum, gauges from Min, Max, Sum/Count and Last. Percentiles are
+// only kept for the instants across agents.
+type point struct {
+	Time        time.Time
+	Count       int64
+	Sum         float64
+	Min         float64
+	Max         float64
+	Last        float64
+	Percentiles []float64
+}
+
+func newPoint(t time.Time, v float64) point {
+	return point{
+		Time:  t,
+		Count: 1,
+		Sum:   v,
+		Min:   v,
+		Max:   v,
+		Last:  v,
+	}
+}
+
+// merge folds q, which does not come before p, into p. Percentiles of
+// merged points are approximated by their mean weighted by count.
+func (p *point) merge(q point) {
+	if p.Count == 0 {
+		t := p.Time
+		*p = q
+		p.Time = t
+		p.Percentiles = append([]float64(nil), q.Percentiles...)
+		return
+	}
+
+	if len(p.Percentiles) == len(q.Percentiles) {
+		percentiles := make([]float64, len(p.Percentiles))
+		for i := range percentiles {
+			percentiles[i] = (p.Percentiles[i]*float64(p.Count) + q.Percentiles[i]*float64(q.Count)) / float64(p.Count+q.Count)
+		}
+
+		p.Percentiles = percentiles
+	}
+
+	p.Count += q.Count
+	p.Sum += q.Sum
+	p.Last = q.Last
+
+	if q.Min < p.Min {
+		p.Min = q.Min
+	}
+
+	if q.Max > p.Max {
+		p.Max = q.Max
+	}
+}
+
+// rollup merges sorted points into points of the given resolution.
+func rollup(points []point, resolution time.Duration) []point {
+	out := []point{}
+
+	for _, q := range points {
+		t := q.Time.Truncate(resolution)
+
+		if n := len(out); n == 0 || !out[n-1].Time.Equal(t) {
+			out = append(out, point{Time: t})
+		}
+
+		out[len(out)-1].merge(q)
+	}
+
+	return out
+}
+
+// between returns the sorted points in [from, to).
+func between(points []point, from, to time.Time) []point {
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Time.Before(from)
+	})
+
+	j := sort.Search(len(points), func(j int) bool {
+		return !points[j].Time.Before(to)
+	})
+
+	if i >= j {
+		return nil
+	}
+
+	return points[i:j]
+}
+
+// glob compiles a glob pattern, * matches any run of characters and ? any
+// single one, slashes included.
+func glob(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.Replace(quoted, `\*`, ".*", -1)
+	quoted = strings.Replace(quoted, `\?`, ".", -1)
+
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+type seriesKey struct {
+	name  string
+	agent string
+	typ   string
+}
+
+// series holds the points of a metric of an agent session, per tier.
+type series struct {
+	Name  string
+	Agent string
+	Type  string
+	tiers [][]point
+}
+
+func (se *series) empty() bool {
+	for _, points := range se.tiers {
+		if len(points) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// store keeps the numbers, instants and log counts of every agent in memory,
+// raw and rolled up into coarser tiers in the background. It is not
+// persisted, a restarted server starts with an empty history.
+type store struct {
+	mu     sync.RWMutex
+	tiers  []Tier
+	rolled []time.Time
+	series map[seriesKey]*series
+}
+
+func newStore(tiers []Tier) (*store, error) {
+	if len(tiers) == 0 || tiers[0].Resolution != 0 {
+		return nil, fmt.Errorf("the first tier must keep the raw points with a zero resolution")
+	}
+
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].Resolution <= 0 {
+			return nil, fmt.Errorf("tier %d has no resolution", i)
+		}
+
+		if i > 1 && (tiers[i].Resolution <= tiers[i-1].Resolution || tiers[i].Resolution%tiers[i-1].Resolution != 0) {
+			return nil, fmt.Errorf("tier resolution %v is not a multiple of %v", tiers[i].Resolution, tiers[i-1].Resolution)
+		}
+
+		if tiers[i].Retention < tiers[i-1].Retention {
+			return nil, fmt.Errorf("tier %d keeps its points for less than tier %d", i, i-1)
+		}
+	}
+
+	s := &store{
+		tiers:  tiers,
+		rolled: make([]time.Time, len(tiers)),
+		series: map[seriesKey]*series{},
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// add stores the numbers, instants and log counts of r as raw points at its
+// start, suppressed messages are counted.
+func (s *store) add(r *pb.Record) {
+	ts := r.Start
+	if ts == nil {
+		ts = r.Ts
+	}
+
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return
+	}
+
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	for k, v := range r.Numbers {
+		s.insert(k, r.Session, numberType, newPoint(t, float64(v)))
+	}
+
+	for k, v := range r.Instants {
+		s.insert(k, r.Session, instantType, newPoint(t, v))
+	}
+
+	for template, logs := range r.Logs {
+		s.insert(template, r.Session, logType, newPoint(t, float64(int64(len(logs.Logs))+logs.Suppressed)))
+	}
+}
+
+// addBucket stores the aggregates of b across agents at its start, under
+// AggregateAgent: the sum of the numbers, with the minimum and maximum
+// agent, and the minimum, maximum, average and percentiles of the
+// instants. Count is the number of agents, Last the sum of the numbers or
+// the average of the instants, so it reads as the latest value once rolled
+// up.
+func (s *store) addBucket(b *bucket, percentiles []float64) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	for k, agents := range b.Numbers {
+		p := point{Time: b.Start}
+		for _, v := range agents {
+			p.merge(newPoint(b.Start, float64(v)))
+		}
+
+		p.Last = p.Sum
+		s.insert(k, AggregateAgent, numberType, p)
+	}
+
+	for k, agents := range b.Instants {
+		values := make([]float64, 0, len(agents))
+		for _, v := range agents {
+			values = append(values, v)
+		}
+
+		sort.Float64s(values)
+
+		p := point{Time: b.Start}
+		for _, v := range values {
+			p.merge(newPoint(b.Start, v))
+		}
+
+		p.Last = p.Sum / float64(p.Count)
+
+		p.Percentiles = make([]float64, len(percentiles))
+		for i, q := range percentiles {
+			p.Percentiles[i] = percentile(values, q)
+		}
+
+		s.insert(k, AggregateAgent, instantType, p)
+	}
+}
+
+// percentile interpolates the q-th percentile of sorted values.
+func percentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+
+	rank := q / 100 * float64(len(sorted)-1)
+	i := int(rank)
+
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+
+	return sorted[i] + (rank-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+func (s *store) insert(name, agent, typ string, p point) {
+	key := seriesKey{name, agent, typ}
+
+	se, ok := s.series[key]
+	if !ok {
+		se = &series{
+			Name:  name,
+			Agent: agent,
+			Type:  typ,
+			tiers: make([][]point, len(s.tiers)),
+		}
+
+		s.series[key] = se
+	}
+
+	raw := se.tiers[0]
+
+	// Records mostly arrive in order, late ones are inserted in place.
+	i := len(raw)
+	for i > 0 && raw[i-1].Time.After(p.Time) {
+		i--
+	}
+
+	raw = append(raw, point{})
+	copy(raw[i+1:], raw[i:])
+	raw[i] = p
+
+	se.tiers[0] = raw
+}
+
+// run rolls up and expires points.
+func (s *store) run() {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	for now := range t.C {
+		s.compact(now)
+	}
+}
+
+// compact rolls up every tier from the one before, up to the intervals
+// no longer expecting points, then drops the points past their retention.
+func (s *store) compact(now time.Time) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	for i := 1; i < len(s.tiers); i++ {
+		until := now.Add(-rollupDelay).Truncate(s.tiers[i].Resolution)
+		if i > 1 && until.After(s.rolled[i-1]) {
+			until = s.rolled[i-1].Truncate(s.tiers[i].Resolution)
+		}
+
+		if !until.After(s.rolled[i]) {
+			continue
+		}
+
+		for _, se := range s.series {
+			points := rollup(between(se.tiers[i-1], s.rolled[i], until), s.tiers[i].Resolution)
+			se.tiers[i] = append(se.tiers[i], points...)
+		}
+
+		s.rolled[i] = until
+	}
+
+	for key, se := range s.series {
+		for i, tier := range s.tiers {
+			points := se.tiers[i]
+
+			j := sort.Search(len(points), func(j int) bool {
+				return now.Sub(points[j].Time) <= tier.Retention
+			})
+
+			if j > 0 {
+				se.tiers[i] = append([]point(nil), points[j:]...)
+			}
+		}
+
+		if se.empty() {
+			delete(s.series, key)
+		}
+	}
+}
+
+// tier picks the finest tier still holding from.
+func (s *store) tier(from time.Time) int {
+	age := time.Since(from)
+
+	for i, tier := range s.tiers {
+		if age <= tier.Retention {
+			return i
+		}
+	}
+
+	return len(s.tiers) - 1
+}
+
+// points returns the points of se in [from, to) at tier i. Intervals not
+// rolled up yet are rolled up from the finer tiers on the fly.
+func (s *store) points(se *series, i int, from, to time.Time) []point {
+	points := append([]point(nil), between(se.tiers[i], from, to)...)
+
+	if i == 0 || !to.After(s.rolled[i]) {
+		return points
+	}
+
+	tail := from
+	if s.rolled[i].After(tail) {
+		tail = s.rolled[i]
+	}
+
+	return append(points, rollup(s.points(se, i-1, tail, to), s.tiers[i].Resolution)...)
+}
+
+// query returns the series whose name matches the glob pattern name, of the
+// given agent session or of all of them but the aggregates, over [from, to).
+// The finest tier still holding from answers.
+func (s *store) query(name, agent string, from, to time.Time) (Tier, []*series) {
+	match := glob(name)
+
+	defer s.mu.RUnlock()
+	s.mu.RLock()
+
+	i := s.tier(from)
+	if i > 0 {
+		from = from.Truncate(s.tiers[i].Resolution)
+	}
+
+	result := []*series{}
+
+	for _, se := range s.series {
+		if agent != "" && se.Agent != agent || agent == "" && se.Agent == AggregateAgent {
+			continue
+		}
+
+		if !match.MatchString(se.Name) {
+			continue
+		}
+
+		points := s.points(se, i, from, to)
+		if len(points) == 0 {
+			continue
+		}
+
+		result = append(result, &series{
+			Name:  se.Name,
+			Agent: se.Agent,
+			Type:  se.Type,
+			tiers: [][]point{points},
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+
+		if result[i].Agent != result[j].Agent {
+			return result[i].Agent < result[j].Agent
+		}
+
+		return result[i].Type < result[j].Type
+	})
+
+	return s.tiers[i], result
+}
+
+// templateCount is the messages of a template over two consecutive windows.
+type templateCount struct {
+	Template  string
+	Count     int64
+	Previous  int64
+	FirstSeen time.Time
+}
+
+// logCounts sums the messages of every template of agent, or of every agent
+// when empty, over [from, mid) as Previous and [mid, to) as Count. The first
+// seen is the first point kept of the template, of any agent.
+func (s *store) logCounts(agent string, from, mid, to time.Time) []*templateCount {
+	defer s.mu.RUnlock()
+	s.mu.RLock()
+
+	i := s.tier(from)
+	if i > 0 {
+		from = from.Truncate(s.tiers[i].Resolution)
+	}
+
+	counts := map[string]*templateCount{}
+
+	for _, se := range s.series {
+		if se.Type != logType {
+			continue
+		}
+
+		c, ok := counts[se.Name]
+		if !ok {
+			c = &templateCount{Template: se.Name}
+			counts[se.Name] = c
+		}
+
+		for _, points := range se.tiers {
+			if len(points) > 0 && (c.FirstSeen.IsZero() || points[0].Time.Before(c.FirstSeen)) {
+				c.FirstSeen = points[0].Time
+			}
+		}
+
+		if agent != "" && se.Agent != agent {
+			continue
+		}
+
+		for _, p := range s.points(se, i, from, to) {
+			if p.Time.Before(mid) {
+				c.Previous += int64(p.Sum)
+			} else {
+				c.Count += int64(p.Sum)
+			}
+		}
+	}
+
+	result := make([]*templateCount, 0, len(counts))
+	for _, c := range counts {
+		if c.Count > 0 || c.Previous > 0 {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
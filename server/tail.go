@@ -0,0 +1,150 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/duanckham/gel/gel"
+	"github.com/duanckham/gel/pb"
+)
+
+// tailBuffer is how many units a subscriber may lag behind before units
+// are dropped for it.
+const tailBuffer = 1024
+
+// subscriber is a Tail call and its filter.
+type subscriber struct {
+	agent    string
+	template string
+	metric   *regexp.Regexp
+	level    gel.Level
+	types    map[string]bool
+	units    chan *pb.Unit
+	dropped  int64
+}
+
+func (s *subscriber) matches(agent string, u gel.RecordUnit) bool {
+	if s.agent != "" && s.agent != agent {
+		return false
+	}
+
+	if len(s.types) > 0 && !s.types[u.T] {
+		return false
+	}
+
+	// Filtering logs only leaves the metrics out, and the other way around.
+	switch u.T {
+	case "log":
+		if u.L < s.level {
+			return false
+		}
+
+		fallthrough
+
+	case "suppressed":
+		if s.template == "" {
+			return s.metric == nil
+		}
+
+		return strings.Contains(u.K, s.template)
+	}
+
+	if s.metric == nil {
+		return s.template == ""
+	}
+
+	return s.metric.MatchString(u.K)
+}
+
+// tails fans the units of the records ingested out to the subscribers.
+// A subscriber lagging behind misses units, ingestion never waits for it.
+type tails struct {
+	mu          sync.RWMutex
+	subscribers map[*subscriber]bool
+}
+
+func newTails() *tails {
+	return &tails{
+		subscribers: map[*subscriber]bool{},
+	}
+}
+
+func (t *tails) subscribe(in *pb.TailRequest) *subscriber {
+	s := &subscriber{
+		agent:    in.Agent,
+		template: in.Template,
+		level:    in.Level,
+		types:    map[string]bool{},
+		units:    make(chan *pb.Unit, tailBuffer),
+	}
+
+	if in.Metric != "" {
+		s.metric = glob(in.Metric)
+	}
+
+	for _, typ := range in.Types {
+		s.types[typ] = true
+	}
+
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	t.subscribers[s] = true
+
+	return s
+}
+
+func (t *tails) unsubscribe(s *subscriber) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	delete(t.subscribers, s)
+}
+
+// publish hands u of agent to the subscribers it matches, without waiting.
+func (t *tails) publish(agent string, u gel.RecordUnit) {
+	defer t.mu.RUnlock()
+	t.mu.RLock()
+
+	for s := range t.subscribers {
+		if !s.matches(agent, u) {
+			continue
+		}
+
+		unit := unitProto(agent, u)
+		unit.Dropped = atomic.SwapInt64(&s.dropped, 0)
+
+		select {
+		case s.units <- unit:
+		default:
+			atomic.AddInt64(&s.dropped, unit.Dropped+1)
+		}
+	}
+}
+
+func unitProto(agent string, u gel.RecordUnit) *pb.Unit {
+	t, _ := ptypes.TimestampProto(u.D)
+
+	unit := &pb.Unit{
+		Type:  u.T,
+		Key:   u.K,
+		Agent: agent,
+		Time:  t,
+		Level: u.L,
+	}
+
+	switch v := u.V.(type) {
+	case int64:
+		unit.Value = float64(v)
+	case float64:
+		unit.Value = v
+	case string:
+		unit.Message = v
+	}
+
+	return unit
+}
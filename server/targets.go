@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultTextTemplate renders a notification as text, one line per alert.
+const DefaultTextTemplate = `{{range .Alerts}}[{{.State}}] {{.Rule}} {{.Series}} {{.Agent}} value={{.Value}} since={{.Since.Format "2006-01-02T15:04:05Z07:00"}}
+{{end}}`
+
+// targetTimeout bounds a single delivery attempt.
+const targetTimeout = 10 * time.Second
+
+var templateFuncs = template.FuncMap{
+	// json quotes a value to embed it in a JSON payload.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func render(t *template.Template, n Notification) (string, error) {
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, n); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// webhook posts notifications to a URL.
+type webhook struct {
+	url    string
+	client *http.Client
+	body   func(n Notification) ([]byte, error)
+}
+
+// NewWebhook returns a target posting every notification to url as JSON.
+// The payload is the Notification, or the text/template tmpl executed with
+// it when not empty, where the json function quotes a value.
+func NewWebhook(url, tmpl string) (Target, error) {
+	w := &webhook{
+		url:    url,
+		client: &http.Client{Timeout: targetTimeout},
+		body: func(n Notification) ([]byte, error) {
+			return json.Marshal(n)
+		},
+	}
+
+	if tmpl != "" {
+		t, err := parseTemplate("webhook", tmpl)
+		if err != nil {
+			return nil, err
+		}
+
+		w.body = func(n Notification) ([]byte, error) {
+			s, err := render(t, n)
+			return []byte(s), err
+		}
+	}
+
+	return w, nil
+}
+
+// NewSlack returns a target posting every notification to a Slack
+// compatible incoming webhook, as the text rendered by the text/template
+// tmpl, DefaultTextTemplate when empty.
+func NewSlack(url, tmpl string) (Target, error) {
+	if tmpl == "" {
+		tmpl = DefaultTextTemplate
+	}
+
+	t, err := parseTemplate("slack", tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: targetTimeout},
+		body: func(n Notification) ([]byte, error) {
+			text, err := render(t, n)
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(map[string]string{
+				"text": text,
+			})
+		},
+	}, nil
+}
+
+func (w *webhook) Send(n Notification) error {
+	body, err := w.body(n)
+	if err != nil {
+		return err
+	}
+
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", w.url, res.Status)
+	}
+
+	return nil
+}
+
+// SMTPConfig configures an SMTP target.
+type SMTPConfig struct {
+	// Addr is the host:port of the server.
+	Addr string
+	// Username and Password authenticate with PLAIN when set.
+	Username string
+	Password string
+	From     string
+	To       []string
+	// Template renders the body, DefaultTextTemplate when empty.
+	Template string
+}
+
+type smtpTarget struct {
+	config   SMTPConfig
+	template *template.Template
+}
+
+// NewSMTP returns a target mailing every notification.
+func NewSMTP(c SMTPConfig) (Target, error) {
+	if len(c.To) == 0 {
+		return nil, fmt.Errorf("smtp: no recipient")
+	}
+
+	tmpl := c.Template
+	if tmpl == "" {
+		tmpl = DefaultTextTemplate
+	}
+
+	t, err := parseTemplate("smtp", tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &smtpTarget{
+		config:   c,
+		template: t,
+	}, nil
+}
+
+func (s *smtpTarget) Send(n Notification) error {
+	body, err := render(s.template, n)
+	if err != nil {
+		return err
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(s.config.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", subject(n))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	return s.send(msg.Bytes())
+}
+
+// send mails msg as smtp.SendMail does, the whole exchange bounded by
+// targetTimeout.
+func (s *smtpTarget) send(msg []byte) error {
+	host, _, _ := net.SplitHostPort(s.config.Addr)
+
+	conn, err := net.DialTimeout("tcp", s.config.Addr, targetTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(targetTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if s.config.Username != "" {
+		auth := smtp.PlainAuth("", s.config.Username, s.config.Password, host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.config.From); err != nil {
+		return err
+	}
+
+	for _, to := range s.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// subject counts the alerts of n by state. Line breaks are removed from the
+// rule name, which would otherwise end the header.
+func subject(n Notification) string {
+	states := []AlertState{}
+	count := map[AlertState]int{}
+
+	for _, a := range n.Alerts {
+		if count[a.State] == 0 {
+			states = append(states, a.State)
+		}
+
+		count[a.State]++
+	}
+
+	parts := []string{}
+	for _, state := range states {
+		parts = append(parts, fmt.Sprintf("%d %s", count[state], state))
+	}
+
+	rule := strings.NewReplacer("\r", "", "\n", "").Replace(n.Rule)
+
+	return fmt.Sprintf("[gel] %s: %s", rule, strings.Join(parts, ", "))
+}
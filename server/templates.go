@@ -0,0 +1,249 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// DefaultTemplatesWindow is the window of Templates when the request has
+// none.
+const DefaultTemplatesWindow = time.Hour
+
+// defaultTemplatesLimit is the length of the lists of Templates and
+// Parameters when the request leaves it out.
+const defaultTemplatesLimit = 10
+
+// Bounds of the values of the parameters tracked.
+const (
+	parameterTemplates = 10000
+	parameterValues    = 64
+)
+
+// valueCounts counts the values at a parameter position. Past
+// parameterValues distinct values, a new value takes the place of the least
+// frequent and its count plus one, so the frequent values stay with counts
+// that are upper bounds.
+type valueCounts struct {
+	counts    map[string]int64
+	total     int64
+	truncated bool
+}
+
+func (vc *valueCounts) add(v string) {
+	vc.total++
+
+	if _, ok := vc.counts[v]; ok || len(vc.counts) < parameterValues {
+		vc.counts[v]++
+		return
+	}
+
+	least := ""
+	min := int64(-1)
+
+	for k, c := range vc.counts {
+		if min < 0 || c < min {
+			least = k
+			min = c
+		}
+	}
+
+	delete(vc.counts, least)
+	vc.counts[v] = min + 1
+	vc.truncated = true
+}
+
+// templateParameters holds the counts of every parameter position of a
+// template.
+type templateParameters struct {
+	positions []*valueCounts
+	messages  int64
+	updated   time.Time
+}
+
+// parameters keeps the values of the parameters of every template, the
+// templates not updated for the longest are forgotten past
+// parameterTemplates.
+type parameters struct {
+	mu        sync.Mutex
+	templates map[string]*templateParameters
+}
+
+func newParameters() *parameters {
+	return &parameters{
+		templates: map[string]*templateParameters{},
+	}
+}
+
+func (ps *parameters) add(r *pb.Record) {
+	if len(r.Logs) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	defer ps.mu.Unlock()
+	ps.mu.Lock()
+
+	for template, logs := range r.Logs {
+		if len(logs.Logs) == 0 {
+			continue
+		}
+
+		tp, ok := ps.templates[template]
+		if !ok {
+			if len(ps.templates) >= parameterTemplates {
+				ps.evict()
+			}
+
+			tp = &templateParameters{}
+			ps.templates[template] = tp
+		}
+
+		tp.updated = now
+
+		for _, m := range logs.Logs {
+			tp.messages++
+
+			for i, v := range m.Parameters {
+				for len(tp.positions) <= i {
+					tp.positions = append(tp.positions, &valueCounts{
+						counts: map[string]int64{},
+					})
+				}
+
+				tp.positions[i].add(v)
+			}
+		}
+	}
+}
+
+// evict forgets the template updated the longest ago.
+func (ps *parameters) evict() {
+	oldest := ""
+	var updated time.Time
+
+	for template, tp := range ps.templates {
+		if oldest == "" || tp.updated.Before(updated) {
+			oldest = template
+			updated = tp.updated
+		}
+	}
+
+	delete(ps.templates, oldest)
+}
+
+// histogram returns the limit most frequent values at every position of
+// the parameters of template, nil when it is not tracked.
+func (ps *parameters) histogram(template string, limit int) *pb.ParametersResponse {
+	defer ps.mu.Unlock()
+	ps.mu.Lock()
+
+	tp, ok := ps.templates[template]
+	if !ok {
+		return nil
+	}
+
+	res := &pb.ParametersResponse{
+		Messages: tp.messages,
+	}
+
+	for _, vc := range tp.positions {
+		values := make([]*pb.ParameterValue, 0, len(vc.counts))
+		for v, c := range vc.counts {
+			values = append(values, &pb.ParameterValue{Value: v, Count: c})
+		}
+
+		sort.Slice(values, func(i, j int) bool {
+			if values[i].Count != values[j].Count {
+				return values[i].Count > values[j].Count
+			}
+
+			return values[i].Value < values[j].Value
+		})
+
+		if len(values) > limit {
+			values = values[:limit]
+		}
+
+		res.Positions = append(res.Positions, &pb.ParameterPosition{
+			Values:    values,
+			Total:     vc.total,
+			Truncated: vc.truncated,
+		})
+	}
+
+	return res
+}
+
+// rankTemplates splits counts into the templates first seen after since,
+// the most frequent first, and the ones growing, the fastest first.
+func rankTemplates(counts []*templateCount, since time.Time, limit int) *pb.TemplatesResponse {
+	growing := []*pb.TemplateStats{}
+	appeared := []*pb.TemplateStats{}
+
+	for _, c := range counts {
+		s := templateStats(c)
+
+		if !c.FirstSeen.Before(since) {
+			appeared = append(appeared, s)
+		} else if c.Count > c.Previous {
+			growing = append(growing, s)
+		}
+	}
+
+	sort.Slice(growing, func(i, j int) bool {
+		if growing[i].Growth != growing[j].Growth {
+			return growing[i].Growth > growing[j].Growth
+		}
+
+		if growing[i].Count != growing[j].Count {
+			return growing[i].Count > growing[j].Count
+		}
+
+		return growing[i].Template < growing[j].Template
+	})
+
+	sort.Slice(appeared, func(i, j int) bool {
+		if appeared[i].Count != appeared[j].Count {
+			return appeared[i].Count > appeared[j].Count
+		}
+
+		return appeared[i].Template < appeared[j].Template
+	})
+
+	if len(growing) > limit {
+		growing = growing[:limit]
+	}
+
+	if len(appeared) > limit {
+		appeared = appeared[:limit]
+	}
+
+	return &pb.TemplatesResponse{
+		Growing:  growing,
+		Appeared: appeared,
+	}
+}
+
+func templateStats(c *templateCount) *pb.TemplateStats {
+	growth := float64(c.Count)
+	if c.Previous > 0 {
+		growth = float64(c.Count-c.Previous) / float64(c.Previous)
+	}
+
+	s := &pb.TemplateStats{
+		Template: c.Template,
+		Count:    c.Count,
+		Previous: c.Previous,
+		Growth:   growth,
+	}
+
+	s.FirstSeen, _ = ptypes.TimestampProto(c.FirstSeen)
+
+	return s
+}
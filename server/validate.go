@@ -0,0 +1,75 @@
+package server
+
+import (
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/duanckham/gel/pb"
+)
+
+// validate rejects the records the server cannot make sense of, with
+// InvalidArgument. A record with no time at all is taken as sent now.
+func validate(r *pb.Record) error {
+	if r.Seq > 0 && r.Session == "" {
+		return status.Error(codes.InvalidArgument, "sequence number without session")
+	}
+
+	if r.Session == AggregateAgent {
+		return status.Errorf(codes.InvalidArgument, "session %q is reserved", AggregateAgent)
+	}
+
+	for k := range r.Numbers {
+		if k == "" {
+			return status.Error(codes.InvalidArgument, "number without name")
+		}
+	}
+
+	for k, v := range r.Instants {
+		if k == "" {
+			return status.Error(codes.InvalidArgument, "instant without name")
+		}
+
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return status.Errorf(codes.InvalidArgument, "instant %q is not finite", k)
+		}
+	}
+
+	for template, logs := range r.Logs {
+		if template == "" || logs == nil {
+			return status.Error(codes.InvalidArgument, "log without template")
+		}
+	}
+
+	for _, ts := range []*timestamp.Timestamp{r.Ts, r.Start, r.End} {
+		if ts == nil {
+			continue
+		}
+
+		if _, err := ptypes.Timestamp(ts); err != nil {
+			return status.Errorf(codes.InvalidArgument, "time: %v", err)
+		}
+	}
+
+	if r.Start == nil {
+		r.Start = r.Ts
+	}
+
+	if r.Start == nil {
+		r.Start, _ = ptypes.TimestampProto(time.Now())
+	}
+
+	if r.Ts == nil {
+		r.Ts = r.Start
+	}
+
+	if r.End == nil {
+		r.End = r.Start
+	}
+
+	return nil
+}
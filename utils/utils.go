@@ -26,3 +26,14 @@ func InterfacesToStrings(d []interface{}) []string {
 
 	return r
 }
+
+// StringsToInterfaces convert the string slice to the interfaces slice.
+func StringsToInterfaces(d []string) []interface{} {
+	r := make([]interface{}, len(d))
+
+	for i, v := range d {
+		r[i] = v
+	}
+
+	return r
+}